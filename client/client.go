@@ -3,11 +3,13 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
-	"net/rpc"
 	"os"
 	"os/exec"
 	"os/signal"
@@ -17,11 +19,13 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/fatih/color"
 	"github.com/spf13/viper"
+	"go-panchaea/internal/modpack"
 )
 
 var wg sync.WaitGroup
@@ -32,25 +36,85 @@ var Logger *log.Logger
 
 var WUAttempts int // Max failures for one WU, default 2
 
+// Code is the built client code of one job
+type Code struct {
+	Job      int
+	Version  int    // Bumped by the server on every reload of the job
+	Filename string // The built node program
+	IOMode   string // How the node program receives the WU: "stdin", "argv" or "file"
+	Broken   bool   // The code could not be built, the server sends no WUs of this version
+}
+
+// Codes contains the client code of each job, fetched with the first WU of the job
+var Codes = make(map[int]*Code)
+
+// codeMut guards Codes, the code is fetched and built by one thread at a time
+var codeMut sync.Mutex
+
+// Platform of the node, the server builds the node program for it
+var Platform = runtime.GOOS + "/" + runtime.GOARCH
+
+// ExitInvalid is the exit code of the node program for WUs which can never be computed (EX_DATAERR)
+const ExitInvalid = 65
+
+// MaxLog is the max size of the node program's stderr sent to the server
+const MaxLog = 64 * 1024
+
+// Limits are applied to the node program of every thread
+type Limits struct {
+	Memory  uint64        // Address space (RLIMIT_AS) in bytes, 0 means no limit
+	CPUTime time.Duration // CPU time (RLIMIT_CPU), 0 means no limit
+	Nice    int           // Nice level, 0 keeps the client's one
+}
+
+var limits Limits
+
+// ErrTimeout means that the node program exceeded the WU timeout or the CPU time limit
+var ErrTimeout = errors.New("WU exceeded its time limit")
+
+// ErrOOM means that the node program exceeded the memory limit
+var ErrOOM = errors.New("WU exceeded the memory limit")
+
 type Receive struct {
-	Data     string
-	Status   string
-	ID       int
-	Bytecode []byte
+	Data       string
+	Status     string
+	ID         int
+	Job        int // ID of the WU's job
+	WorkUnit   int
+	Bytecode   []byte
+	Log        string   // stderr of the node program, capped at MaxLog
+	Platform   string   // GOOS/GOARCH of the node, sent with "hello" and Init
+	Token      string   // Join token of the cluster, sent with "hello"
+	NodeKey    string   // Persistent identity of the node, sent with "hello" if the node has a key file
+	Node       NodeInfo // Sent with "hello"
+	Credential string   // Issued by the server on "hello", sent with every call
+	Version    int      // Code version the node could not build, sent with "broken"
 }
 
 type Reply struct {
-	Data     string
-	ID       int
-	Bytecode []byte
+	Data       string
+	ID         int
+	Job        int // ID of the WU's job
+	WorkUnit   int
+	Bytecode   []byte
+	IOMode     string        // How the node program receives the WU, only sent by Init
+	Timeout    time.Duration // Time the WU may be computed, 0 if there is no limit
+	Prebuilt   bool          // Bytecode is the node program built for this node, only sent by Init
+	Hash       string        // SHA-256 of Bytecode, only sent by Init
+	Version    int           // Code version of the job
+	Credential string        // Issued on "hello"
 }
 
 type Thread struct {
-	ID       int
-	Status   string // "ready", "downloading", "uploading", "running", "failed"
-	WorkUnit []byte
-	Result   []byte
-	Attempts int
+	ID         int
+	Status     string // "ready", "downloading", "uploading", "running", "failed"
+	Job        int    // Job of the WU
+	Code       *Code  // Client code the WU is computed with
+	WorkUnitID int    // Assigned by the server
+	WorkUnit   []byte
+	Timeout    time.Duration // Time the WU may be computed, 0 if there is no limit
+	Result     []byte
+	Attempts   int
 }
 
 var Threads []Thread
@@ -94,7 +158,7 @@ func printWarn(s string) {
 	Logger.Println("[W]:    " + s)
 }
 
-func console(ID int, kill chan bool, input chan string) {
+func console(conn *Conn, kill chan bool, input chan string) {
 	defer wg.Done()
 	for {
 		select {
@@ -102,7 +166,7 @@ func console(ID int, kill chan bool, input chan string) {
 			return
 		default:
 			cmd := ""
-			fmt.Print("[" + strconv.Itoa(ID) + "] cli > ")
+			fmt.Print("[" + strconv.Itoa(conn.NodeID()) + "] cli > ")
 			// fmt.Scanln(&cmd)
 			go func() {
 				fmt.Scanln(&input)
@@ -126,7 +190,7 @@ func console(ID int, kill chan bool, input chan string) {
 	}
 }
 
-func initConn(addr, threads string) (*rpc.Client, string, string, error) {
+func initConn(addr, threads string) (*Conn, string, string, error) {
 	printSuccess("Connecting to the server...")
 	if *overwrite {
 		printWarn("Please type in the server ip and port, separated by :")
@@ -134,7 +198,7 @@ func initConn(addr, threads string) (*rpc.Client, string, string, error) {
 		fmt.Print("    ")
 		fmt.Scanln(&addr)
 	}
-	client, err := rpc.Dial("tcp", addr)
+	client, err := dial(addr)
 	if err != nil {
 		return nil, "", "", err
 	}
@@ -149,62 +213,106 @@ func initConn(addr, threads string) (*rpc.Client, string, string, error) {
 		return nil, "", "", err
 	}
 	WUAttempts = 2
-	return client, addr, threads, nil
+	return &Conn{client: client, addr: addr, threads: threads, ID: -1}, addr, threads, nil
 }
 
-func sendStatus(receive Receive, client *rpc.Client) (Reply, error) {
+func sendStatus(receive Receive, conn *Conn) (Reply, error) {
 	var reply Reply
-	err := client.Call("Listener.SendStatus", receive, &reply)
+	err := conn.Call("Listener.SendStatus", receive, &reply)
 	if err != nil {
 		return reply, err
 	}
 	return reply, nil
 }
 
-func fetchCode(receive Receive, client *rpc.Client) (Reply, error) {
+func fetchCode(receive Receive, conn *Conn) (Reply, error) {
 	var reply Reply
-	err := client.Call("Listener.Init", receive, &reply)
+	err := conn.Call("Listener.Init", receive, &reply)
 	if err != nil {
 		return reply, err
 	}
 	return reply, nil
 }
 
-func sendBytecode(receive Receive, client *rpc.Client) (Reply, error) {
+func sendBytecode(receive Receive, conn *Conn) (Reply, error) {
 	var reply Reply
-	err := client.Call("Listener.FetchWorkUnit", receive, &reply)
+	err := conn.Call("Listener.FetchWorkUnit", receive, &reply)
 	if err != nil {
 		return reply, err
 	}
 	return reply, nil
 }
 
-func getBytecode(receive Receive, client *rpc.Client, thread int) (Reply, error) {
+func getBytecode(receive Receive, conn *Conn, thread int) (Reply, error) {
 	var reply Reply
-	err := client.Call("Listener.SendWorkUnit", receive, &reply)
+	err := conn.Call("Listener.SendWorkUnit", receive, &reply)
 	if err != nil {
 		return reply, err
 	}
 	return reply, nil
 }
 
-func reloadBytecode(receive Receive, client *rpc.Client, thread int) (Reply, error) {
+func reloadBytecode(receive Receive, conn *Conn, thread int) (Reply, error) {
 	var reply Reply
-	err := client.Call("Listener.ReloadWorkUnit", receive, &reply)
+	err := conn.Call("Listener.ReloadWorkUnit", receive, &reply)
 	if err != nil {
 		return reply, err
 	}
 	return reply, nil
 }
 
-func writeCode(code []byte, filename string) (string, error) {
-	if _, err := os.Stat("build"); os.IsNotExist(err) {
-		err := os.Mkdir("build", 0755)
+// binaryName returns the file name of the built node program
+func binaryName() string {
+	if runtime.GOOS == "windows" {
+		return "build.exe"
+	}
+	return "build"
+}
+
+// installCode verifies the client code by its SHA-256 and builds it into build/cache/<hash>.
+// The build is skipped if the same code is already there
+func installCode(code []byte, filename, hash string, prebuilt bool) (string, error) {
+	sum := sha256.Sum256(code)
+	actual := hex.EncodeToString(sum[:])
+	if hash != "" && hash != actual {
+		return "", errors.New("Client code is corrupted: SHA-256 is " + actual + ", expected " + hash)
+	}
+	dir := filepath.Join("build", "cache", actual)
+	file_out := filepath.Join(dir, binaryName())
+	if _, err := os.Stat(file_out); err == nil {
+		printSuccess("Client code " + actual[:12] + " is already built")
+		return file_out, nil
+	}
+	// Leftovers of an interrupted build
+	err := os.RemoveAll(dir)
+	if err != nil {
+		return "", err
+	}
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", err
+	}
+	if prebuilt {
+		return writeBinary(code, dir)
+	}
+	fname, err := writeCode(code, filename, dir)
+	if err != nil {
+		return "", err
+	}
+	return buildCode(fname, dir)
+}
+
+func writeCode(code []byte, filename, dir string) (string, error) {
+	if strings.HasSuffix(filename, modpack.Suffix) {
+		dir = filepath.Join(dir, strings.TrimSuffix(filepath.Base(filename), modpack.Suffix))
+		err := modpack.Unpack(code, dir)
 		if err != nil {
-			printErr(err.Error())
+			return dir, err
 		}
+		printSuccess("Client module is unpacked!")
+		return dir, nil
 	}
-	filename = filepath.Join("build", filename)
+	filename = filepath.Join(dir, filepath.Base(filename))
 	f, err := os.Create(filename)
 	if err != nil {
 		return filename, err
@@ -218,24 +326,52 @@ func writeCode(code []byte, filename string) (string, error) {
 	return filename, nil
 }
 
-func buildCode(filename string) (string, error) {
+// writeBinary saves the node program built by the server
+func writeBinary(code []byte, dir string) (string, error) {
+	file_out := filepath.Join(dir, binaryName())
+	tmp := filepath.Join(dir, "tmp_"+binaryName())
+	err := ioutil.WriteFile(tmp, code, 0755)
+	if err != nil {
+		return file_out, err
+	}
+	err = os.Rename(tmp, file_out)
+	if err != nil {
+		return file_out, err
+	}
+	printSuccess("Prebuilt client code is written!")
+	return file_out, nil
+}
+
+func buildCode(filename, dir string) (string, error) {
 	flag := "-o"
-	output := "build"
 	goexec, err := exec.LookPath("go")
 	if err != nil {
 		return "", err
 	}
 	if runtime.GOOS == "windows" {
 		flag = "/o"
-		output = "build.exe"
 		goexec, err = exec.LookPath("go.exe")
 		if err != nil {
 			return "", err
 		}
 	}
-	cmd := exec.Command(goexec, "build", flag, filepath.Join("build", output), filename)
+	file_out := filepath.Join(dir, binaryName())
+	// The output is renamed after the build, so a broken build is never taken from the cache
+	tmp, err := filepath.Abs(filepath.Join(dir, "tmp_"+binaryName()))
+	if err != nil {
+		return "", err
+	}
+	cmd := exec.Command(goexec, "build", flag, tmp, filename)
+	if info, err := os.Stat(filename); err == nil && info.IsDir() {
+		// The module is built in its own directory, with the vendored dependencies if there are any
+		args := []string{"build", flag, tmp}
+		if _, err := os.Stat(filepath.Join(filename, "vendor")); err == nil {
+			args = append(args, "-mod=vendor")
+		}
+		cmd = exec.Command(goexec, append(args, ".")...)
+		cmd.Dir = filename
+	}
 	fmt.Println(cmd)
-	file_out := filepath.Join("build", output)
 	var out, stderr bytes.Buffer
 	cmd.Stdout = &out
 	cmd.Stderr = &stderr
@@ -247,6 +383,11 @@ func buildCode(filename string) (string, error) {
 	if stderr.String() != "" {
 		color.Red(stderr.String())
 	}
+	if err != nil {
+		// The compiler output is sent to the server
+		return file_out, errors.New(err.Error() + "\n" + strings.TrimSpace(stderr.String()))
+	}
+	err = os.Rename(tmp, file_out)
 	if err != nil {
 		return file_out, err
 	}
@@ -254,11 +395,11 @@ func buildCode(filename string) (string, error) {
 	return file_out, nil
 }
 
-func connect(client *rpc.Client, threads string) (error, []byte, string, int) {
+func connect(conn *Conn, threads string) (error, int) {
 	var reply Reply
-	reply, err := sendStatus(Receive{Data: threads, Status: "hello", ID: -1}, client)
+	reply, err := sendStatus(Receive{Data: threads, Status: "hello", ID: -1, Platform: Platform, Token: conn.token, NodeKey: conn.key, Node: nodeInfo()}, conn)
 	if err != nil {
-		return err, nil, "", -1
+		return err, -1
 	}
 	if reply.Data == "ok" {
 		printSuccess("Connected! Your ID is " + strconv.Itoa(reply.ID))
@@ -266,29 +407,68 @@ func connect(client *rpc.Client, threads string) (error, []byte, string, int) {
 		printErr(reply.Data)
 	}
 	ID := reply.ID
-	reply, err = sendStatus(Receive{Data: "", Status: "ready", ID: ID}, client)
+	conn.mut.Lock()
+	conn.ID = ID
+	conn.credential = reply.Credential
+	conn.mut.Unlock()
+	reply, err = sendStatus(Receive{Data: "", Status: "ready", ID: ID}, conn)
 	if err != nil {
-		return err, nil, "", ID
+		return err, ID
 	}
 	if reply.Data != "ok" {
 		printErr(reply.Data)
 	}
-	printSuccess("Fetching client code...")
-	reply, err = fetchCode(Receive{Data: "", Status: "ready", ID: ID}, client)
-	if err != nil {
-		return err, nil, "", ID
+	return nil, ID
+}
+
+// loadCode returns the client code of the job, it is fetched and built if the node has another version
+func loadCode(conn *Conn, job, version int) (*Code, error) {
+	codeMut.Lock()
+	defer codeMut.Unlock()
+	code, ok := Codes[job]
+	if !ok || code.Version != version {
+		code = updateCode(conn, job)
+		Codes[job] = code
 	}
-	if reply.Data == "error" {
-		printErr("Could not fetch the client file")
-	} else {
-		printSuccess("Code is downloaded!")
+	if code.Broken {
+		return nil, errors.New("Client code of job " + strconv.Itoa(job) + " could not be built")
 	}
-	return nil, reply.Bytecode, reply.Data, ID
+	return code, nil
 }
 
-func fetchWU(client *rpc.Client, thread *Thread, ID int) error {
-	rec := Receive{Data: strconv.Itoa(thread.ID), Status: "download", ID: ID}
-	reply, err := getBytecode(rec, client, thread.ID)
+// updateCode fetches the client code of the job and builds it. If the build fails, the node is reported as broken,
+// so the server sends no WUs of the job until it is reloaded
+func updateCode(conn *Conn, job int) *Code {
+	printSuccess("Fetching client code of job " + strconv.Itoa(job) + "...")
+	reply, err := fetchCode(Receive{Data: "", Status: "ready", ID: conn.NodeID(), Job: job, Platform: Platform}, conn)
+	if err == nil && reply.Data == "error" {
+		err = errors.New("Could not fetch the client file")
+	}
+	code := &Code{Job: job, Version: reply.Version, IOMode: reply.IOMode}
+	if code.IOMode == "" {
+		// Older servers pass the WU as an argument
+		code.IOMode = "argv"
+	}
+	if err == nil {
+		printSuccess("Code is downloaded! WUs are passed via " + code.IOMode)
+		code.Filename, err = installCode(reply.Bytecode, reply.Data, reply.Hash, reply.Prebuilt)
+	}
+	if err != nil {
+		printErr("Could not build the client code of job " + strconv.Itoa(job) + ": " + err.Error())
+		code.Broken = true
+		_, serr := sendStatus(Receive{Data: capLog([]byte(err.Error())), Status: "broken", ID: conn.NodeID(), Job: job, Version: code.Version}, conn)
+		if serr != nil {
+			printErr(serr.Error())
+		}
+		return code
+	}
+	printSuccess("Code version " + strconv.Itoa(code.Version) + " of job " + strconv.Itoa(job) + " is installed")
+	return code
+}
+
+func fetchWU(conn *Conn, thread *Thread) error {
+	rec := Receive{Data: strconv.Itoa(thread.ID), Status: "download", ID: conn.NodeID()}
+	reply, err := getBytecode(rec, conn, thread.ID)
 	if err != nil {
 		printErr(err.Error())
 		thread.Status = "failed"
@@ -299,38 +479,137 @@ func fetchWU(client *rpc.Client, thread *Thread, ID int) error {
 		thread.Status = "failed"
 		return errors.New("WU download failed")
 	}
+	code, err := loadCode(conn, reply.Job, reply.Version)
+	if err != nil {
+		// The server has already released the WU
+		thread.Status = "ready"
+		return err
+	}
+	thread.Job = reply.Job
+	thread.Code = code
+	thread.WorkUnitID = reply.WorkUnit
 	thread.WorkUnit = reply.Bytecode
+	thread.Timeout = reply.Timeout
 	thread.Status = "running"
 	return nil
 }
 
-func processWU(client *rpc.Client, filename string, thread *Thread, ID int) {
+// runWorker runs the node program and returns its result. The WU is passed according to IOMode:
+// "stdin" writes it to stdin and reads stdout, "argv" passes it as the first argument and reads stdout,
+// "file" passes the input and the output file paths
+func runWorker(thread *Thread, stderr *bytes.Buffer) ([]byte, error) {
+	filename := thread.Code.Filename
 	prefix := "./"
 	if runtime.GOOS == "windows" {
 		prefix = ".\\"
 	}
-	cmd := exec.Command(prefix+filename, string(thread.WorkUnit))
-	var out, stderr bytes.Buffer
+	var cmd *exec.Cmd
+	var in, res string
+	switch thread.Code.IOMode {
+	case "stdin":
+		cmd = exec.Command(prefix + filename)
+		cmd.Stdin = bytes.NewReader(thread.WorkUnit)
+	case "file":
+		in = filepath.Join("build", "wu_"+strconv.Itoa(thread.ID)+".in")
+		res = filepath.Join("build", "wu_"+strconv.Itoa(thread.ID)+".out")
+		err := ioutil.WriteFile(in, thread.WorkUnit, 0644)
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(in)
+		os.Remove(res)
+		defer os.Remove(res)
+		cmd = exec.Command(prefix+filename, in, res)
+	default:
+		cmd = exec.Command(prefix+filename, string(thread.WorkUnit))
+	}
+	var out bytes.Buffer
 	cmd.Stdout = &out
-	cmd.Stderr = &stderr
-	err := cmd.Run()
+	cmd.Stderr = stderr
+	prepareCmd(cmd)
+	err := cmd.Start()
 	if err != nil {
-		Logger.Println("[E]:    " + err.Error())
-		thread.Status = "failed"
-		rec := Receive{Data: err.Error(), Status: "error " + strconv.Itoa(thread.ID), ID: ID}
-		sendBytecode(rec, client)
-		return
+		return nil, err
 	}
-	res := out.Bytes()
-	if stderr.String() != "" {
-		Logger.Println("[E]:    " + stderr.String())
-		thread.Status = "failed"
-		rec := Receive{Data: stderr.String(), Status: "error " + strconv.Itoa(thread.ID), ID: ID}
-		sendBytecode(rec, client)
+	err = applyLimits(cmd.Process.Pid)
+	if err != nil {
+		killTree(cmd)
+		cmd.Wait()
+		return nil, err
+	}
+	var expired int32
+	if thread.Timeout > 0 {
+		timer := time.AfterFunc(thread.Timeout, func() {
+			atomic.StoreInt32(&expired, 1)
+			killTree(cmd)
+		})
+		defer timer.Stop()
+	}
+	err = cmd.Wait()
+	if atomic.LoadInt32(&expired) == 1 {
+		return nil, ErrTimeout
+	}
+	if err != nil {
+		if reason := exitReason(err, stderr.Bytes()); reason != nil {
+			return nil, reason
+		}
+		return nil, err
+	}
+	if thread.Code.IOMode == "file" {
+		return ioutil.ReadFile(res)
+	}
+	return out.Bytes(), nil
+}
+
+// capLog keeps the end of the node program's stderr, which usually contains the error
+func capLog(stderr []byte) string {
+	if len(stderr) <= MaxLog {
+		return string(stderr)
+	}
+	return "..." + string(stderr[len(stderr)-MaxLog:])
+}
+
+// lastLine returns the last non-empty line of the log
+func lastLine(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+func processWU(conn *Conn, thread *Thread) {
+	var stderr bytes.Buffer
+	res, err := runWorker(thread, &stderr)
+	logs := capLog(stderr.Bytes())
+	if logs != "" {
+		Logger.Println("[W]:    [" + strconv.Itoa(thread.ID) + "] stderr of WU " + strconv.Itoa(thread.WorkUnitID) + ":\n" + logs)
+	}
+	if err != nil {
+		msg := err.Error()
+		if logs != "" {
+			msg += ": " + lastLine(logs)
+		}
+		Logger.Println("[E]:    " + msg)
+		status := "error "
+		if err == ErrTimeout {
+			status = "timeout "
+		} else if err == ErrOOM {
+			status = "oom "
+		} else if exit, ok := err.(*exec.ExitError); ok && exit.ExitCode() == ExitInvalid {
+			// Retrying is pointless, the server drops the WU
+			status = "invalid "
+		}
+		rec := Receive{Data: msg, Status: status + strconv.Itoa(thread.ID), ID: conn.NodeID(), Job: thread.Job, WorkUnit: thread.WorkUnitID, Log: logs}
+		sendBytecode(rec, conn)
+		if status == "error " {
+			thread.Status = "failed"
+		} else {
+			// The WU would fail on this node again, the server sends it to another one
+			printErr("[" + strconv.Itoa(thread.ID) + "] WU " + strconv.Itoa(thread.WorkUnitID) + ": " + msg)
+			thread.Status = "ready"
+		}
 		return
 	}
-	rec := Receive{Data: strconv.Itoa(thread.ID), Status: "upload", ID: ID, Bytecode: res}
-	reply, err := sendBytecode(rec, client)
+	rec := Receive{Data: strconv.Itoa(thread.ID), Status: "upload", ID: conn.NodeID(), Job: thread.Job, WorkUnit: thread.WorkUnitID, Bytecode: res, Log: logs}
+	reply, err := sendBytecode(rec, conn)
 	if reply.Data != "ok" {
 		Logger.Println("[E]:    " + reply.Data)
 		printErr(reply.Data)
@@ -340,9 +619,9 @@ func processWU(client *rpc.Client, filename string, thread *Thread, ID int) {
 	return
 }
 
-func reloadWU(client *rpc.Client, thread *Thread, ID int) error {
-	rec := Receive{Data: strconv.Itoa(thread.ID), Status: "download", ID: ID}
-	reply, err := reloadBytecode(rec, client, thread.ID)
+func reloadWU(conn *Conn, thread *Thread) error {
+	rec := Receive{Data: strconv.Itoa(thread.ID), Status: "download", ID: conn.NodeID(), Job: thread.Job, WorkUnit: thread.WorkUnitID}
+	reply, err := reloadBytecode(rec, conn, thread.ID)
 	if err != nil {
 		printErr(err.Error())
 		thread.Status = "failed"
@@ -364,7 +643,14 @@ func reloadWU(client *rpc.Client, thread *Thread, ID int) error {
 			return errors.New("Unknown WU reload error!")
 		}
 	}
+	code, err := loadCode(conn, reply.Job, reply.Version)
+	if err != nil {
+		thread.Status = "failed"
+		return err
+	}
+	thread.Code = code
 	thread.WorkUnit = reply.Bytecode
+	thread.Timeout = reply.Timeout
 	thread.Status = "running"
 	return nil
 }
@@ -386,7 +672,7 @@ func initLogger() (*os.File, error) {
 	return f, nil
 }
 
-func handleThreads(client *rpc.Client, ID int, filename string) error {
+func handleThreads(conn *Conn) error {
 	defer wg.Done()
 	for {
 		select {
@@ -400,32 +686,30 @@ func handleThreads(client *rpc.Client, ID int, filename string) error {
 				default:
 					if Threads[i].Status == "ready" {
 						Threads[i].Attempts = 0
-						err := fetchWU(client, &Threads[i], ID)
+						err := fetchWU(conn, &Threads[i])
 						if err != nil {
-							Threads[i].Status = "failed"
 							printErr("[" + strconv.Itoa(Threads[i].ID) + "] " + err.Error())
 							continue
 						}
 						printSuccess("WU is succesfully downloaded!")
 						Threads[i].Status = "running"
-						go processWU(client, filename, &Threads[i], ID)
+						go processWU(conn, &Threads[i])
 					} else if Threads[i].Status == "failed" {
 						if Threads[i].Attempts >= WUAttempts {
 							printErr("WU failed too many times! Fetching new WU...")
 							Threads[i].Attempts = 0
-							err := fetchWU(client, &Threads[i], ID)
+							err := fetchWU(conn, &Threads[i])
 							if err != nil {
-								Threads[i].Status = "failed"
 								printErr("[" + strconv.Itoa(Threads[i].ID) + "] " + err.Error())
 								continue
 							}
 							Threads[i].Status = "running"
-							go processWU(client, filename, &Threads[i], ID)
+							go processWU(conn, &Threads[i])
 							continue
 						}
 						printErr("Reloading WU due to runtime or download error..")
 						Threads[i].Attempts++
-						err := reloadWU(client, &Threads[i], ID)
+						err := reloadWU(conn, &Threads[i])
 						if err != nil {
 							printErr("[" + strconv.Itoa(Threads[i].ID) + "] " + err.Error())
 							Threads[i].Status = "failed"
@@ -433,7 +717,7 @@ func handleThreads(client *rpc.Client, ID int, filename string) error {
 							continue
 						}
 						Threads[i].Status = "running"
-						go processWU(client, filename, &Threads[i], ID)
+						go processWU(conn, &Threads[i])
 					}
 				}
 			}
@@ -442,7 +726,7 @@ func handleThreads(client *rpc.Client, ID int, filename string) error {
 }
 
 func initContext(kill chan bool) {
-	cont, cls := context.WithTimeout(context.Background(), time.Second)
+	cont, cls := context.WithCancel(context.Background())
 	ctx = cont
 	go func() {
 		<-kill
@@ -465,11 +749,28 @@ func handleCleanExit(f *os.File, input chan string) {
 	close(input)
 }
 
-func initTicker() *time.Ticker {
-	tick := time.NewTicker(time.Second)
+func initTicker(interval time.Duration) *time.Ticker {
+	tick := time.NewTicker(interval)
 	return tick
 }
 
+func handleHeartbeat(conn *Conn, tick *time.Ticker) {
+	defer wg.Done()
+	for {
+		select {
+		case <-ctx.Done():
+			tick.Stop()
+			return
+		case <-tick.C:
+			var reply Reply
+			err := conn.Call("Listener.Heartbeat", Receive{Data: "", Status: "heartbeat", ID: conn.NodeID()}, &reply)
+			if err != nil {
+				Logger.Println("[E]:    Heartbeat failed: " + err.Error())
+			}
+		}
+	}
+}
+
 func initConfig() (string, string, *viper.Viper) {
 	v := viper.New()
 	dir, fname := filepath.Split(*config_file)
@@ -479,6 +780,17 @@ func initConfig() (string, string, *viper.Viper) {
 	filename := strings.Split(fname, ".")
 	v.SetDefault("Addr", "")
 	v.SetDefault("Threads", "4")
+	v.SetDefault("Heartbeat", "5s")
+	v.SetDefault("MaxMemory", "0")
+	v.SetDefault("MaxCPUTime", "0s")
+	v.SetDefault("Nice", 0)
+	v.SetDefault("TLS", false)
+	v.SetDefault("TLSCA", "")
+	v.SetDefault("TLSCert", "")
+	v.SetDefault("TLSKey", "")
+	v.SetDefault("TLSServerName", "")
+	v.SetDefault("JoinToken", "")
+	v.SetDefault("NodeKeyFile", "")
 	v.SetConfigName(filename[0])
 	v.SetConfigType(filename[1])
 	v.AddConfigPath(dir)
@@ -533,7 +845,20 @@ func main() {
 			printSuccess("threads: " + threads)
 		}
 	}
-	client, addr, threads, err := initConn(addr, threads)
+	kill := make(chan bool, 1)
+	initContext(kill)
+	tlsConfig, err = initTLS(v)
+	if err != nil {
+		printErr(err.Error())
+		os.Exit(1)
+	}
+	conn, addr, threads, err := initConn(addr, threads)
+	if err != nil {
+		printErr(err.Error())
+		os.Exit(1)
+	}
+	conn.token = v.GetString("JoinToken")
+	conn.key, err = loadNodeKey(v.GetString("NodeKeyFile"))
 	if err != nil {
 		printErr(err.Error())
 		os.Exit(1)
@@ -549,26 +874,27 @@ func main() {
 			printErr(err.Error())
 		}
 	}
-	err, bytecode, filename, ID := connect(client, threads)
+	err, _ = connect(conn, threads)
 	if err != nil {
 		printErr(err.Error())
 		os.Exit(1)
 	}
-	fname, err := writeCode(bytecode, filename)
-	if err != nil {
-		printErr(err.Error())
-		os.Exit(1)
-	}
-	out, err := buildCode(fname)
-	fmt.Println(out)
 	initThreads(thr)
-	kill := make(chan bool, 1)
 	input := make(chan string, 1)
-	initContext(kill)
 	go handleInterrupt(kill)
 	go handleCleanExit(logfile, input)
-	wg.Add(2)
-	go console(ID, kill, input)
-	go handleThreads(client, ID, out)
+	heartbeat := v.GetDuration("Heartbeat")
+	if heartbeat <= 0 {
+		printWarn("Invalid heartbeat interval, using 5s")
+		heartbeat = time.Second * 5
+	}
+	limits = Limits{Memory: uint64(v.GetSizeInBytes("MaxMemory")), CPUTime: v.GetDuration("MaxCPUTime"), Nice: v.GetInt("Nice")}
+	if runtime.GOOS != "linux" && limits != (Limits{}) {
+		printWarn("Resource limits are only supported on Linux, ignoring them")
+	}
+	wg.Add(3)
+	go handleHeartbeat(conn, initTicker(heartbeat))
+	go console(conn, kill, input)
+	go handleThreads(conn)
 	wg.Wait()
 }
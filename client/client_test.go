@@ -0,0 +1,179 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// module packs the files like the server packs a module
+func module(t *testing.T, names ...string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	body := []byte("package main\n")
+	for _, name := range names {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(body))}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write(body)
+	}
+	tw.Close()
+	gz.Close()
+	return buf.Bytes()
+}
+
+func TestCapLog(t *testing.T) {
+	tail := strings.Repeat("b", MaxLog)
+	tests := []struct {
+		name   string
+		stderr string
+		want   string
+	}{
+		{"empty", "", ""},
+		{"short", "panic: oops\n", "panic: oops\n"},
+		{"limit", tail, tail},
+		{"long", "a" + tail, "..." + tail},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := capLog([]byte(tt.stderr)); got != tt.want {
+				t.Errorf("capLog = %.20q (%d bytes), want %.20q (%d bytes)", got, len(got), tt.want, len(tt.want))
+			}
+		})
+	}
+}
+
+func TestLastLine(t *testing.T) {
+	tests := []struct {
+		log  string
+		want string
+	}{
+		{"", ""},
+		{"exit status 1", "exit status 1"},
+		{"goroutine 1:\npanic: oops\n", "panic: oops"},
+		{"first\n  last  \n\n\n", "last"},
+		{"first\r\nlast\r\n", "last"},
+	}
+	for _, tt := range tests {
+		if got := lastLine(tt.log); got != tt.want {
+			t.Errorf("lastLine(%q) = %q, want %q", tt.log, got, tt.want)
+		}
+	}
+}
+
+func TestWriteCodeModule(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []string
+		ok    bool
+	}{
+		{"module", []string{"go.mod", "main.go", "internal/w/w.go"}, true},
+		{"parent", []string{"main.go", "../evil.go"}, false},
+		{"nested parent", []string{"internal/../../../evil.go"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "panchaea")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			cache := filepath.Join(dir, "cache")
+			out, err := writeCode(module(t, tt.files...), "worker.tar.gz", cache)
+			if (err == nil) != tt.ok {
+				t.Fatalf("writeCode = %v, want ok: %v", err, tt.ok)
+			}
+			if out != filepath.Join(cache, "worker") {
+				t.Errorf("module is written to %s", out)
+			}
+			if _, err := os.Stat(filepath.Join(dir, "evil.go")); !os.IsNotExist(err) {
+				t.Error("file is written outside of the module")
+			}
+			if _, err := os.Stat(filepath.Join(cache, "evil.go")); !os.IsNotExist(err) {
+				t.Error("file is written outside of the module")
+			}
+			for _, name := range tt.files {
+				if _, err := os.Stat(filepath.Join(out, filepath.FromSlash(name))); tt.ok && err != nil {
+					t.Error(err)
+				}
+			}
+		})
+	}
+}
+
+func TestInstallCode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "panchaea")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The builds are cached in the working directory
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	code := []byte("prebuilt node program")
+	sum := sha256.Sum256(code)
+	hash := hex.EncodeToString(sum[:])
+	cached := filepath.Join("build", "cache", hash, binaryName())
+	tests := []struct {
+		name   string
+		hash   string
+		cached string // Contents of the cached build, none if empty
+		want   string // Contents of the installed build, an error if empty
+	}{
+		{"corrupted", strings.Repeat("0", 64), "", ""},
+		{"corrupted cached", strings.Repeat("0", 64), "old build", ""},
+		{"install", hash, "", string(code)},
+		{"no hash", "", "", string(code)},
+		{"cache hit", hash, "old build", "old build"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.RemoveAll("build")
+			if tt.cached != "" {
+				if err := os.MkdirAll(filepath.Dir(cached), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := ioutil.WriteFile(cached, []byte(tt.cached), 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			out, err := installCode(code, "worker", tt.hash, true)
+			if tt.want == "" {
+				if err == nil {
+					t.Fatalf("installCode accepts code with SHA-256 %s, expected %s", hash, tt.hash)
+				}
+				if _, err := os.Stat(filepath.Join("build", "cache", tt.hash)); !os.IsNotExist(err) {
+					t.Error("corrupted code is installed")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if out != cached {
+				t.Errorf("installCode = %s, want %s", out, cached)
+			}
+			data, err := ioutil.ReadFile(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.want {
+				t.Errorf("installed build is %q, want %q", data, tt.want)
+			}
+		})
+	}
+}
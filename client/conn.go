@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/rpc"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MaxBackoff is the longest delay between the reconnection attempts
+const MaxBackoff = time.Second * 30
+
+// Conn is the connection to the server, which is re-established if it is lost
+type Conn struct {
+	mut     sync.Mutex
+	client  *rpc.Client
+	addr    string
+	threads string
+	token   string // Join token, sent with "hello"
+	key     string // Persistent identity of the node, empty if there is no key file
+	ID      int
+
+	credential string // Issued by the server on "hello"
+}
+
+func dial(addr string) (*rpc.Client, error) {
+	if tlsConfig == nil {
+		return rpc.Dial("tcp", addr)
+	}
+	conn, err := tls.Dial("tcp", addr, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	return rpc.NewClient(conn), nil
+}
+
+func isConnError(err error) bool {
+	if err == rpc.ErrShutdown || err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	_, ok := err.(net.Error)
+	return ok
+}
+
+// Call calls the server method, waiting for the reconnection if the connection is lost
+func (c *Conn) Call(method string, receive Receive, reply *Reply) error {
+	for {
+		c.mut.Lock()
+		client := c.client
+		if receive.ID != -1 {
+			// The server may have issued a new ID on the reconnection
+			receive.ID = c.ID
+		}
+		receive.Credential = c.credential
+		c.mut.Unlock()
+		err := client.Call(method, receive, reply)
+		if err == nil || !isConnError(err) {
+			return err
+		}
+		printErr("Connection to the server is lost: " + err.Error())
+		err = c.reconnect(client)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// NodeID returns the ID which the server has issued to the node
+func (c *Conn) NodeID() int {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.ID
+}
+
+// reconnect dials the server until it responds and re-identifies the node with its previous ID
+func (c *Conn) reconnect(old *rpc.Client) error {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if c.client != old {
+		// Another thread has already reconnected
+		return nil
+	}
+	old.Close()
+	delay := time.Second
+	for {
+		client, err := dial(c.addr)
+		if err == nil {
+			var reply Reply
+			err = client.Call("Listener.SendStatus", Receive{Data: c.threads, Status: "hello", ID: c.ID, Platform: Platform, Token: c.token, NodeKey: c.key, Node: nodeInfo(), Credential: c.credential}, &reply)
+			if err == nil && reply.Data == "ok" {
+				c.ID = reply.ID
+				c.credential = reply.Credential
+				err = client.Call("Listener.SendStatus", Receive{Data: "", Status: "ready", ID: c.ID, Credential: c.credential}, &reply)
+			}
+			if err != nil && err.Error() == "Unauthorized" {
+				// The join token is not accepted anymore, retrying won't help
+				client.Close()
+				return errors.New("Server rejected the join token")
+			}
+			if err == nil {
+				c.client = client
+				printSuccess("Reconnected! Your ID is " + strconv.Itoa(c.ID))
+				return nil
+			}
+			client.Close()
+		}
+		printWarn("Could not reconnect: " + err.Error() + ", retrying in " + delay.String())
+		select {
+		case <-ctx.Done():
+			return errors.New("Reconnection is aborted")
+		case <-time.After(delay):
+		}
+		delay *= 2
+		if delay > MaxBackoff {
+			delay = MaxBackoff
+		}
+	}
+}
+
+// Close closes the connection
+func (c *Conn) Close() error {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	return c.client.Close()
+}
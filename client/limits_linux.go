@@ -0,0 +1,88 @@
+package main
+
+import (
+	"os/exec"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// prepareCmd starts the node program in its own process group, so its children are killed with it
+func prepareCmd(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// prlimit sets the resource limit of another process
+func prlimit(pid int, resource int, lim *syscall.Rlimit) error {
+	_, _, errno := syscall.RawSyscall6(syscall.SYS_PRLIMIT64, uintptr(pid), uintptr(resource), uintptr(unsafe.Pointer(lim)), 0, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// applyLimits sets the memory and CPU time limits and the nice level of the started node program
+func applyLimits(pid int) error {
+	if limits.Memory > 0 {
+		lim := syscall.Rlimit{Cur: limits.Memory, Max: limits.Memory}
+		err := prlimit(pid, syscall.RLIMIT_AS, &lim)
+		if err != nil {
+			return err
+		}
+	}
+	if limits.CPUTime > 0 {
+		sec := uint64(limits.CPUTime.Seconds())
+		if sec == 0 {
+			sec = 1
+		}
+		// The process gets SIGXCPU at the soft limit and SIGKILL at the hard one
+		lim := syscall.Rlimit{Cur: sec, Max: sec + 1}
+		err := prlimit(pid, syscall.RLIMIT_CPU, &lim)
+		if err != nil {
+			return err
+		}
+	}
+	if limits.Nice != 0 {
+		err := syscall.Setpriority(syscall.PRIO_PROCESS, pid, limits.Nice)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// killTree kills the node program with all its children
+func killTree(cmd *exec.Cmd) {
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
+
+// exitReason checks if the node program was stopped by a limit
+func exitReason(err error, stderr []byte) error {
+	exit, ok := err.(*exec.ExitError)
+	if !ok {
+		return nil
+	}
+	status, ok := exit.Sys().(syscall.WaitStatus)
+	if ok && status.Signaled() {
+		switch status.Signal() {
+		case syscall.SIGXCPU:
+			return ErrTimeout
+		case syscall.SIGKILL:
+			if limits.CPUTime > 0 {
+				// The hard CPU limit is reached
+				return ErrTimeout
+			}
+			// Most likely the kernel OOM killer
+			return ErrOOM
+		}
+	}
+	if limits.Memory > 0 {
+		s := strings.ToLower(string(stderr))
+		for _, msg := range []string{"out of memory", "cannot allocate memory", "failed to reserve", "bad_alloc"} {
+			if strings.Contains(s, msg) {
+				return ErrOOM
+			}
+		}
+	}
+	return nil
+}
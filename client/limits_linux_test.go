@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestExitReason(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits Limits
+		script string // Run by sh to get the exit error
+		stderr string
+		want   error
+	}{
+		{"success", Limits{}, "exit 0", "", nil},
+		{"failure", Limits{Memory: 1 << 30}, "exit 1", "panic: oops", nil},
+		{"cpu soft limit", Limits{CPUTime: time.Second}, "kill -XCPU $$", "", ErrTimeout},
+		{"cpu hard limit", Limits{CPUTime: time.Second}, "kill -KILL $$", "", ErrTimeout},
+		{"oom killer", Limits{}, "kill -KILL $$", "", ErrOOM},
+		{"allocation failure", Limits{Memory: 1 << 30}, "exit 2", "fatal error: Out of memory", ErrOOM},
+		{"bad_alloc", Limits{Memory: 1 << 30}, "exit 134", "std::bad_alloc", ErrOOM},
+		{"no memory limit", Limits{}, "exit 2", "fatal error: out of memory", nil},
+	}
+	defer func(l Limits) { limits = l }(limits)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limits = tt.limits
+			err := exec.Command("sh", "-c", tt.script).Run()
+			if got := exitReason(err, []byte(tt.stderr)); got != tt.want {
+				t.Errorf("exitReason(%v) = %v, want %v", err, got, tt.want)
+			}
+		})
+	}
+	if got := exitReason(errors.New("fork failed"), nil); got != nil {
+		t.Errorf("exitReason of a start error = %v, want nil", got)
+	}
+}
@@ -0,0 +1,26 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"os/exec"
+)
+
+// prepareCmd does nothing, process groups are only used on Linux
+func prepareCmd(cmd *exec.Cmd) {}
+
+// applyLimits does nothing, the limits are only supported on Linux
+func applyLimits(pid int) error {
+	return nil
+}
+
+// killTree kills the node program
+func killTree(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
+
+// exitReason does nothing, the limits are only supported on Linux
+func exitReason(err error, stderr []byte) error {
+	return nil
+}
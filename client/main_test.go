@@ -0,0 +1,14 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	// main sets the logger up before anything is printed
+	Logger = log.New(ioutil.Discard, "", 0)
+	os.Exit(m.Run())
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
+)
+
+// Version is the Panchaea release of the node, it is reported to the server on join
+const Version = "0.5.0"
+
+// NodeInfo describes the machine of the node, it is reported with "hello"
+type NodeInfo struct {
+	Hostname string
+	OS       string
+	Arch     string
+	CPUs     int
+	Version  string // Panchaea release of the node
+}
+
+func nodeInfo() NodeInfo {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return NodeInfo{Hostname: hostname, OS: runtime.GOOS, Arch: runtime.GOARCH, CPUs: runtime.NumCPU(), Version: Version}
+}
+
+// loadNodeKey reads the persistent identity of the node, so it keeps its ID after a restart.
+// The key is generated if the file doesn't exist, there is no identity if filename is empty
+func loadNodeKey(filename string) (string, error) {
+	if filename == "" {
+		return "", nil
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err == nil {
+		key := strings.TrimSpace(string(data))
+		if key == "" {
+			return "", errors.New("Node key file " + filename + " is empty")
+		}
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+	buf := make([]byte, 32)
+	_, err = rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	key := hex.EncodeToString(buf)
+	err = ioutil.WriteFile(filename, []byte(key+"\n"), 0600)
+	if err != nil {
+		return "", err
+	}
+	printSuccess("Node key is generated in " + filename)
+	return key, nil
+}
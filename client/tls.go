@@ -0,0 +1,45 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+
+	"github.com/spf13/viper"
+)
+
+// tlsConfig is used to dial the server, nil if the connection is not encrypted
+var tlsConfig *tls.Config
+
+// initTLS prepares the TLS connection to the server if TLS is set. The server certificate is verified
+// with TLSCA (the system roots by default), TLSCert and TLSKey are presented if the server requires a node certificate
+func initTLS(v *viper.Viper) (*tls.Config, error) {
+	if !v.GetBool("TLS") {
+		return nil, nil
+	}
+	config := &tls.Config{ServerName: v.GetString("TLSServerName"), MinVersion: tls.VersionTLS12}
+	if caFile := v.GetString("TLSCA"); caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("No certificates found in " + caFile)
+		}
+		config.RootCAs = pool
+	}
+	certFile, keyFile := v.GetString("TLSCert"), v.GetString("TLSKey")
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, errors.New("Both TLSCert and TLSKey must be set")
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, errors.New("Could not load the TLS certificate: " + err.Error())
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// writeCert writes a self-signed certificate and its key into dir
+func writeCert(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "panchaea"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, "node.crt"), filepath.Join(dir, "node.key")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestInitTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "panchaea")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cert, key := writeCert(t, dir)
+	empty := filepath.Join(dir, "empty.pem")
+	if err := ioutil.WriteFile(empty, []byte("not a certificate"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		config map[string]interface{}
+		ok     bool
+	}{
+		{"disabled", map[string]interface{}{"TLSCA": "missing.pem"}, true},
+		{"system roots", map[string]interface{}{"TLS": true}, true},
+		{"ca", map[string]interface{}{"TLS": true, "TLSCA": cert}, true},
+		{"missing ca", map[string]interface{}{"TLS": true, "TLSCA": filepath.Join(dir, "missing.pem")}, false},
+		{"ca without certificates", map[string]interface{}{"TLS": true, "TLSCA": empty}, false},
+		{"node certificate", map[string]interface{}{"TLS": true, "TLSCA": cert, "TLSCert": cert, "TLSKey": key}, true},
+		{"certificate without key", map[string]interface{}{"TLS": true, "TLSCert": cert}, false},
+		{"key without certificate", map[string]interface{}{"TLS": true, "TLSKey": key}, false},
+		{"invalid key", map[string]interface{}{"TLS": true, "TLSCert": cert, "TLSKey": empty}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := viper.New()
+			for k, val := range tt.config {
+				v.Set(k, val)
+			}
+			config, err := initTLS(v)
+			if (err == nil) != tt.ok {
+				t.Fatalf("initTLS = %v, want ok: %v", err, tt.ok)
+			}
+			if err != nil {
+				return
+			}
+			if !v.GetBool("TLS") {
+				if config != nil {
+					t.Error("TLS is used while it is disabled")
+				}
+				return
+			}
+			if (config.RootCAs != nil) != v.IsSet("TLSCA") {
+				t.Errorf("RootCAs are set: %v, TLSCA is set: %v", config.RootCAs != nil, v.IsSet("TLSCA"))
+			}
+			if (len(config.Certificates) == 1) != v.IsSet("TLSCert") {
+				t.Errorf("%d node certificates, TLSCert is set: %v", len(config.Certificates), v.IsSet("TLSCert"))
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+// Package modpack extracts the Go modules which the server ships to the nodes as client code
+package modpack
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Suffix marks the client code which is a packed Go module rather than one file
+const Suffix = ".tar.gz"
+
+// Unpack extracts the module archive into dir. Paths leaving dir, links and special files are rejected
+func Unpack(data []byte, dir string) error {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := filepath.FromSlash(hdr.Name)
+		target := filepath.Join(root, name)
+		if filepath.IsAbs(name) || !strings.HasPrefix(target, root+string(os.PathSeparator)) {
+			return errors.New("Module archive contains an unsafe path: " + hdr.Name)
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, 0755)
+		case tar.TypeReg:
+			err = WriteFile(target, tr, os.FileMode(hdr.Mode).Perm()|0600)
+		default:
+			return errors.New("Module archive contains an unsupported file: " + hdr.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// WriteFile writes the file and creates its parent directories
+func WriteFile(filename string, r io.Reader, mode os.FileMode) error {
+	err := os.MkdirAll(filepath.Dir(filename), 0755)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,94 @@
+package modpack
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// archive packs the entries like a submitted module
+func archive(t *testing.T, entries ...*tar.Header) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, hdr := range entries {
+		body := []byte("package modpack\n")
+		if hdr.Typeflag == tar.TypeReg {
+			hdr.Size = int64(len(body))
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			tw.Write(body)
+		}
+	}
+	tw.Close()
+	gz.Close()
+	return buf.Bytes()
+}
+
+func TestUnpack(t *testing.T) {
+	tests := []struct {
+		name  string
+		entry *tar.Header
+		ok    bool
+	}{
+		{"file", &tar.Header{Name: "plugin/main.go", Typeflag: tar.TypeReg, Mode: 0644}, true},
+		{"dir", &tar.Header{Name: "plugin/", Typeflag: tar.TypeDir, Mode: 0755}, true},
+		{"parent", &tar.Header{Name: "../evil.go", Typeflag: tar.TypeReg, Mode: 0644}, false},
+		{"nested parent", &tar.Header{Name: "plugin/../../evil.go", Typeflag: tar.TypeReg, Mode: 0644}, false},
+		{"root", &tar.Header{Name: ".", Typeflag: tar.TypeDir, Mode: 0755}, false},
+		{"symlink", &tar.Header{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"}, false},
+		{"hard link", &tar.Header{Name: "link", Typeflag: tar.TypeLink, Linkname: "../evil.go"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "panchaea")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			target := filepath.Join(dir, "module")
+			err = Unpack(archive(t, tt.entry), target)
+			if (err == nil) != tt.ok {
+				t.Fatalf("Unpack = %v, want ok: %v", err, tt.ok)
+			}
+			// Nothing is written outside of the module directory
+			files, err := ioutil.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, f := range files {
+				if f.Name() != "module" {
+					t.Errorf("%s is written outside of the module", f.Name())
+				}
+			}
+			if tt.ok && tt.entry.Typeflag == tar.TypeReg {
+				if _, err := os.Stat(filepath.Join(target, tt.entry.Name)); err != nil {
+					t.Error(err)
+				}
+			}
+		})
+	}
+}
+
+func TestUnpackAbsolute(t *testing.T) {
+	dir, err := ioutil.TempDir("", "panchaea")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.ToSlash(filepath.Join(dir, "evil.go"))
+	err = Unpack(archive(t, &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644}), filepath.Join(dir, "module"))
+	if err == nil {
+		t.Fatal("Unpack accepts an absolute path")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "evil.go")); !os.IsNotExist(err) {
+		t.Error("file with an absolute path is written")
+	}
+}
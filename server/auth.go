@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// JoinTokens are the tokens the nodes present with "hello" to join the cluster. Any node may join if there are none
+var JoinTokens []string
+
+// APIToken must be sent as "Authorization: Bearer <token>" with the API requests which change the jobs or the policies.
+// The API only shows the jobs if it is not set
+var APIToken string
+
+// ErrUnauthorized is returned to the calls without a valid join token or credential
+var ErrUnauthorized = errors.New("Unauthorized")
+
+// initAuth reads the join tokens and the API token from the config file
+func initAuth(v *viper.Viper) {
+	APIToken = v.GetString("APIToken")
+	JoinTokens = nil
+	for _, token := range v.GetStringSlice("JoinTokens") {
+		if token != "" {
+			JoinTokens = append(JoinTokens, token)
+		}
+	}
+	if len(JoinTokens) == 0 {
+		printWarn("JoinTokens are not set, any node which reaches the port may join")
+	}
+}
+
+// validJoinToken checks the token the node presented with "hello"
+func validJoinToken(token string) bool {
+	if len(JoinTokens) == 0 {
+		return true
+	}
+	valid := false
+	for _, t := range JoinTokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			valid = true
+		}
+	}
+	return valid
+}
+
+// newCredential generates the secret the node sends with every call after "hello"
+func newCredential() (string, error) {
+	buf := make([]byte, 32)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// authorize finds the client which made the call and checks its credential. Only the authorized calls
+// record that the client is alive
+func authorize(data Receive, reply *Reply) (*Client, error) {
+	mut.Lock()
+	var cl *Client
+	for i := range Clients {
+		if Clients[i].ID == data.ID {
+			cl = Clients[i]
+			break
+		}
+	}
+	valid := cl != nil && cl.credential != "" && subtle.ConstantTimeCompare([]byte(cl.credential), []byte(data.Credential)) == 1
+	if valid {
+		cl.LastSeen = time.Now()
+	}
+	mut.Unlock()
+	if cl == nil {
+		printErr("[" + strconv.Itoa(data.ID) + "] " + "Client not found!")
+		*reply = Reply{Data: "client not found", ID: data.ID}
+		return nil, errors.New("Client not found")
+	}
+	if !valid {
+		printErr("[" + strconv.Itoa(data.ID) + "] " + "Call is rejected: invalid credential")
+		*reply = Reply{Data: "unauthorized", ID: data.ID}
+		return nil, ErrUnauthorized
+	}
+	return cl, nil
+}
+
+// sameOrigin checks that a browser sent the request from the dashboard itself. The commands send no Origin
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+// requireToken guards the API handler: the requests other than GET must carry APIToken, they are refused if it is not set.
+// Any web page may post to the dashboard, even on 127.0.0.1, so only the token proves that the operator sent the request
+func requireToken(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			h(w, r)
+			return
+		}
+		if !sameOrigin(r) {
+			http.Error(w, "Cross-origin requests can't change the jobs", http.StatusForbidden)
+			return
+		}
+		if APIToken == "" {
+			http.Error(w, "Set APIToken to change the jobs through the API", http.StatusForbidden)
+			return
+		}
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") || subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(APIToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
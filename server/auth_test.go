@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireToken(t *testing.T) {
+	tests := []struct {
+		name   string
+		token  string // APIToken of the server
+		method string
+		origin string
+		auth   string
+		status int
+	}{
+		{"cross-origin post without token", "", http.MethodPost, "http://evil.example", "", http.StatusForbidden},
+		{"local post without token", "", http.MethodPost, "", "", http.StatusForbidden},
+		{"cross-origin post", "secret", http.MethodPost, "http://evil.example", "", http.StatusForbidden},
+		{"cross-origin post with token", "secret", http.MethodPost, "http://evil.example", "Bearer secret", http.StatusForbidden},
+		{"opaque origin", "secret", http.MethodPost, "null", "Bearer secret", http.StatusForbidden},
+		{"no token", "secret", http.MethodPost, "", "", http.StatusUnauthorized},
+		{"wrong token", "secret", http.MethodPost, "", "Bearer guess", http.StatusUnauthorized},
+		{"not bearer", "secret", http.MethodPost, "", "secret", http.StatusUnauthorized},
+		{"command", "secret", http.MethodPost, "", "Bearer secret", http.StatusOK},
+		{"dashboard", "secret", http.MethodPost, "http://127.0.0.1:7521", "Bearer secret", http.StatusOK},
+		{"cross-origin get", "", http.MethodGet, "http://evil.example", "", http.StatusOK},
+	}
+	defer func(token string) { APIToken = token }(APIToken)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			APIToken = tt.token
+			called := false
+			h := requireToken(func(w http.ResponseWriter, r *http.Request) {
+				called = true
+			})
+			// A form which any web page may post without a preflight
+			var body bytes.Buffer
+			form := multipart.NewWriter(&body)
+			part, _ := form.CreateFormFile("Module", "plugin.tar.gz")
+			part.Write([]byte("plugin"))
+			form.Close()
+			r := httptest.NewRequest(tt.method, "http://127.0.0.1:7521/api/jobs", &body)
+			r.Header.Set("Content-Type", form.FormDataContentType())
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if tt.auth != "" {
+				r.Header.Set("Authorization", tt.auth)
+			}
+			w := httptest.NewRecorder()
+			h(w, r)
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+			if called != (tt.status == http.StatusOK) {
+				t.Errorf("handler called = %v with status %d", called, w.Code)
+			}
+		})
+	}
+}
@@ -7,8 +7,12 @@ import (
 	"time"
 )
 
-// Timeout before the workunit is considered to be stuck
-var Timeout time.Duration
+// Settings of the job, the values from panchaea_server.json take precedence
+var Settings = struct {
+	MaxAttempts   int           // Max failures of one WU
+	Timeout       time.Duration // Time before the workunit is considered to be stuck
+	PrepareAmount int           // Amount of WUs to be generated
+}{MaxAttempts: 2, Timeout: time.Second * 1000, PrepareAmount: 10}
 
 // Result of a WorkUnit
 type Result struct {
@@ -24,23 +28,20 @@ type WorkUnit struct {
 
 // Server represents the code written by the user
 type Server struct {
-	Current       int      // Current client
-	PrepareAmount int      // Amount of WUs to be generated
-	WorkUnits     [][]byte // List of prepared WUs, stored in JSON
-	Custom        []byte   // Custom server data, stored in JSON
+	Current   int      // Current client
+	WorkUnits [][]byte // List of prepared WUs, stored in JSON
+	Custom    []byte   // Custom server data, stored in JSON
 }
 
 // Init is being run at the startup
 func (s *Server) Init() {
 	s.Current = 0
-	s.PrepareAmount = 10
-	Timeout = time.Second * 1000
 }
 
 // Run gets current call id and returns WU
 func (s *Server) Run(id int) ([]byte, error) {
 	if len(s.WorkUnits) == 0 {
-		err := s.Prepare(s.PrepareAmount)
+		err := s.Prepare(Settings.PrepareAmount)
 		if err != nil {
 			return nil, err
 		}
@@ -79,6 +80,10 @@ func (s *Server) Prepare(amount int) error {
 func (s *Server) Process(res [][]byte) error {
 	comp := make([]Result, 0)
 	for _, v := range res {
+		if len(v) == 0 {
+			// The WU is failed or invalid
+			continue
+		}
 		var r Result
 		err := json.Unmarshal(v, &r)
 		if err != nil {
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// CodeMode is "source" if the nodes build the client code themselves, "binary" if the server builds it for them
+var CodeMode string
+
+// buildBinary cross-compiles the client code of the job for the node's platform. Each platform is built once
+func (job *Job) buildBinary(platform string) ([]byte, error) {
+	job.binMut.Lock()
+	defer job.binMut.Unlock()
+	if bin, ok := job.binaries[platform]; ok {
+		return bin, nil
+	}
+	target := strings.Split(platform, "/")
+	if len(target) != 2 || target[0] == "" || target[1] == "" {
+		return nil, errors.New("Unknown node platform: \"" + platform + "\"")
+	}
+	goexec, err := exec.LookPath("go")
+	if err != nil {
+		return nil, err
+	}
+	output := "worker_" + job.Name + "_" + target[0] + "_" + target[1]
+	if target[0] == "windows" {
+		output += ".exe"
+	}
+	out, err := filepath.Abs(filepath.Join("build", output))
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(goexec, "build", "-o", out, job.ClientPath)
+	if info, err := os.Stat(job.ClientPath); err == nil && info.IsDir() {
+		args := []string{"build", "-o", out}
+		if _, err := os.Stat(filepath.Join(job.ClientPath, "vendor")); err == nil {
+			args = append(args, "-mod=vendor")
+		}
+		cmd = exec.Command(goexec, append(args, ".")...)
+		cmd.Dir = job.ClientPath
+	}
+	cmd.Env = append(os.Environ(), "GOOS="+target[0], "GOARCH="+target[1], "CGO_ENABLED=0")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	printSuccess("Building the client code of job " + job.Name + " for " + platform + "...")
+	err = cmd.Run()
+	if err != nil {
+		return nil, errors.New("Could not build the client code of job " + job.Name + " for " + platform + ": " + strings.TrimSpace(stderr.String()))
+	}
+	bin, err := ioutil.ReadFile(out)
+	if err != nil {
+		return nil, err
+	}
+	job.binaries[platform] = bin
+	printSuccess("Client code of job " + job.Name + " for " + platform + " is built (" + strconv.Itoa(len(bin)) + " bytes)")
+	return bin, nil
+}
@@ -14,6 +14,11 @@ var app = new Vue({
   el: '#dashboard',
   data: {
     status: '...',
+    progress: -1,
+    jobs: [],
+    headless: false,
+    finishPolicy: '',
+    dumpOnExit: '',
     statusWrapperColor: 'c11-bg c0-fg',
     isWarningsCollapsed: true,
     isErrorsCollapsed: true,
@@ -40,6 +45,47 @@ var app = new Vue({
       this.errorsCount = this.errors.length
       Vue.toasted.show(this.errorIcon + " " + err)
     },
+    showPolicy: function (policy) {
+      this.headless = policy.Headless
+      this.finishPolicy = policy.FinishPolicy
+      this.dumpOnExit = policy.DumpOnExit
+    },
+    apiConfig: function () {
+      token = localStorage.getItem('apiToken')
+      return token ? {headers: {Authorization: 'Bearer ' + token}} : {}
+    },
+    apiError: function (error) {
+      if (error.response && error.response.status == 401) {
+        token = window.prompt('API token of the server')
+        if (token != null) {
+          localStorage.setItem('apiToken', token)
+        }
+      }
+      this.newError(error.response ? error.response.data : error.message)
+    },
+    getPolicy: function () {
+      axios
+      .get('api/policy')
+      .then(resp => this.showPolicy(resp.data))
+      .catch(error => this.newError(error.message))
+    },
+    setPolicy: function () {
+      params = new URLSearchParams()
+      params.append('FinishPolicy', this.finishPolicy)
+      params.append('DumpOnExit', this.dumpOnExit)
+      axios
+      .post('api/policy', params, this.apiConfig())
+      .then(resp => this.showPolicy(resp.data))
+      .catch(error => {
+        this.apiError(error)
+        this.getPolicy()
+      })
+    },
+    finishJob: function (id) {
+      axios
+      .post('api/jobs/' + id + '/finish', null, this.apiConfig())
+      .catch(error => this.apiError(error))
+    },
     getData: function () {
       axios
       .get('api')
@@ -75,6 +121,12 @@ var app = new Vue({
               break
         }
 	this.statusWrapperColor = stColor
+	this.progress = response.Progress < 0 ? -1 : Math.round(response.Progress * 100)
+	this.jobs = []
+	for (let i = 0; i < response.Jobs.length; i++) {
+	  job = response.Jobs[i]
+	  this.jobs.push({id: job.ID, name: job.Name, status: job.Status, version: job.Version, progress: job.Progress < 0 ? -1 : Math.round(job.Progress * 100), finishing: job.Finishing})
+	}
 	this.nodes = []
 	for (let i = 0; i < response.Clients.length; i++) {
           color = 'c3-fg'
@@ -90,8 +142,21 @@ var app = new Vue({
             case 'failed':
               color = 'c1-fg'
               break
+            case 'lost':
+              color = 'c7-fg'
+              break
+            case 'broken':
+              color = 'c5-fg'
+              break
+          }
+          lastSeen = new Date(response.Clients[i].LastSeen).toLocaleTimeString()
+          log = Object.values(response.Clients[i].Broken || {}).map(b => b.Log).join('\n')
+          node = response.Clients[i].Node
+          host = node.Hostname + ', ' + node.CPUs + ' CPUs, Panchaea ' + node.Version
+          if (response.Clients[i].Disagreed > 0) {
+            host += ', ' + response.Clients[i].Disagreed + ' result(s) disagreed with the quorum'
           }
-          this.nodes.push({id: response.Clients[i].Id, threads: response.Clients[i].Threads, status: response.Clients[i].Status, statusColor: color, load: "&#960" + "1" + ";", isRunning: running})
+          this.nodes.push({id: response.Clients[i].ID, threads: response.Clients[i].Threads, status: response.Clients[i].Status, statusColor: color, load: "&#960" + "1" + ";", isRunning: running, lastSeen: lastSeen, platform: response.Clients[i].Platform, host: host, log: log})
         }
         /* for (let i = 0; i < response.WorkUnits.length; i++) {
           id = this.workUnits.Client.Id
@@ -109,6 +174,7 @@ var app = new Vue({
     }
   },
  mounted() {
+     this.getPolicy()
      this.getData()
  }
 })
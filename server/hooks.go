@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"time"
+)
+
+// Deadliner is an optional plugin interface, which sets the timeout of each WU
+type Deadliner interface {
+	Deadline(data []byte) time.Duration
+}
+
+// Collector is an optional plugin interface, which receives each result as soon as it is uploaded.
+// If it is implemented, results are not kept in memory and Process receives nil
+type Collector interface {
+	Collect(id int, result []byte) error
+}
+
+// ClientJoiner is an optional plugin interface, which is notified when a new client connects
+type ClientJoiner interface {
+	OnClientJoin(id int)
+}
+
+// FailureWatcher is an optional plugin interface, which is notified when a WU fails
+type FailureWatcher interface {
+	OnWorkUnitFailed(data []byte, err error)
+}
+
+// ShutdownHandler is an optional plugin interface, which is called before the server exits
+type ShutdownHandler interface {
+	OnShutdown()
+}
+
+// ProgressReporter is an optional plugin interface, which reports the progress of the job from 0 to 1
+type ProgressReporter interface {
+	Progress() float64
+}
+
+// Validator is an optional plugin interface, which compares two results of the WU computed by different nodes.
+// Without it the results must be byte-equal
+type Validator interface {
+	Validate(a, b []byte) bool
+}
+
+// initHooks detects the optional methods of the plugin's Server. The hooks of the previous plugin are dropped
+func (job *Job) initHooks(servInter interface{}) {
+	job.hookMut.Lock()
+	defer job.hookMut.Unlock()
+	job.deadliner, job.collector, job.joiner, job.watcher, job.shutdowner, job.reporter, job.validator = nil, nil, nil, nil, nil, nil, nil
+	if d, ok := servInter.(Deadliner); ok {
+		printSuccess("Plugin sets the timeout of each WU")
+		job.deadliner = d
+	}
+	if c, ok := servInter.(Collector); ok {
+		printSuccess("Plugin collects the results as they are uploaded")
+		job.collector = c
+	}
+	if j, ok := servInter.(ClientJoiner); ok {
+		job.joiner = j
+	}
+	if w, ok := servInter.(FailureWatcher); ok {
+		job.watcher = w
+	}
+	if s, ok := servInter.(ShutdownHandler); ok {
+		job.shutdowner = s
+	}
+	if r, ok := servInter.(ProgressReporter); ok {
+		printSuccess("Plugin reports the progress of the job")
+		job.reporter = r
+	}
+	if v, ok := servInter.(Validator); ok {
+		printSuccess("Plugin validates the results of the replicated WUs")
+		job.validator = v
+	}
+}
+
+// collecting checks if the plugin collects the results itself
+func (job *Job) collecting() bool {
+	job.hookMut.Lock()
+	defer job.hookMut.Unlock()
+	return job.collector != nil
+}
+
+// wuTimeout returns the time the WU may be computed, 0 if there is no limit
+func (job *Job) wuTimeout(data []byte) time.Duration {
+	job.hookMut.Lock()
+	d := time.Duration(0)
+	if job.deadliner != nil {
+		d = job.deadliner.Deadline(data)
+	}
+	job.hookMut.Unlock()
+	if d > 0 {
+		return d
+	}
+	return job.sched.Settings().Timeout
+}
+
+// collect passes the result of the WU to the plugin. The WU is sent again if the plugin rejects it
+func (job *Job) collect(wu *WorkUnit, result []byte) {
+	job.hookMut.Lock()
+	if job.collector == nil {
+		// The plugin is reloaded and does not collect the results anymore
+		job.hookMut.Unlock()
+		return
+	}
+	err := job.collector.Collect(wu.ID, result)
+	job.hookMut.Unlock()
+	if err != nil {
+		printErr("Job " + job.Name + ": the result of WU " + strconv.Itoa(wu.ID) + " is rejected by the plugin: " + err.Error())
+		job.sched.Reject(wu)
+		job.workUnitFailed(wu.Data, err)
+	}
+}
+
+// clientJoined notifies every job about the new client
+func clientJoined(ID int) {
+	for _, job := range allJobs() {
+		job.hookMut.Lock()
+		if job.joiner != nil {
+			job.joiner.OnClientJoin(ID)
+		}
+		job.hookMut.Unlock()
+	}
+}
+
+func (job *Job) workUnitFailed(data []byte, err error) {
+	job.hookMut.Lock()
+	defer job.hookMut.Unlock()
+	if job.watcher == nil {
+		return
+	}
+	job.watcher.OnWorkUnitFailed(data, err)
+}
+
+func (job *Job) shutdown() {
+	job.hookMut.Lock()
+	defer job.hookMut.Unlock()
+	if job.shutdowner == nil {
+		return
+	}
+	job.shutdowner.OnShutdown()
+}
+
+// progress returns the progress of the job from 0 to 1, -1 if the plugin does not report it
+func (job *Job) progress() float64 {
+	job.hookMut.Lock()
+	defer job.hookMut.Unlock()
+	if job.reporter == nil {
+		return -1
+	}
+	return job.reporter.Progress()
+}
+
+// sameResult checks if the two results of the WU agree
+func (job *Job) sameResult(a, b []byte) bool {
+	job.hookMut.Lock()
+	defer job.hookMut.Unlock()
+	if job.validator == nil {
+		return bytes.Equal(a, b)
+	}
+	return job.validator.Validate(a, b)
+}
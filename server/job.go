@@ -0,0 +1,480 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+// Job is a server plugin with its client code and its own WU queue. All jobs share the nodes
+type Job struct {
+	ID       int
+	Name     string
+	Priority int    // Jobs with a higher priority get the nodes first
+	Weight   int    // Share of the nodes among the jobs with the same priority
+	Status   string // "READY", "RUNNING", "FINISH", "FAILED", "PAUSED", "CANCELED"
+
+	config *viper.Viper // Job's part of the config file
+
+	serv    Server
+	servMut sync.RWMutex // Run and Process hold it for reading, so the plugin is never swapped during a call
+
+	hookMut    sync.Mutex // The optional plugin methods are never called concurrently, it also guards the hooks
+	deadliner  Deadliner
+	collector  Collector
+	joiner     ClientJoiner
+	watcher    FailureWatcher
+	shutdowner ShutdownHandler
+	reporter   ProgressReporter
+	validator  Validator
+
+	settings Settings // Guarded by the scheduler lock, the scheduler reads it with the lock held
+
+	sched    *Scheduler
+	journal  *Journal
+	Replayed map[string]int // Data of the restored WUs, so the regenerated ones are not sent twice
+
+	ClientPath  string // Client file or module directory
+	ServerPath  string // Plugin source file
+	ClientFile  []byte // Code sent to the nodes, either one file or the tar.gz of a module
+	Filename    string // File name of the code, ends with .tar.gz for a module
+	CodeVersion int    // Bumped on every reload, the nodes fetch the code again when it changes
+	clientHash  string
+	serverHash  string
+
+	binaries map[string][]byte // Client code built by the server, by platform ("GOOS/GOARCH")
+	binMut   sync.Mutex
+
+	reloadMut sync.Mutex // Only one reload of the job runs at a time
+	exhausted bool       // The plugin has no more WUs
+	finishing bool       // Finish waits for the running WUs
+	finishNow bool       // The job is finished from the dashboard without waiting
+	finished  chan bool
+}
+
+// Jobs contains the jobs in the order of submission
+var Jobs []*Job
+
+// NewJob creates a job from its part of the config file, which may set its Name, Priority, Weight,
+// JournalFile and settings. The job is not registered until it is loaded
+func NewJob(v *viper.Viper, client_file, server_file string) (*Job, error) {
+	name := jobName(v, server_file)
+	weight := 1
+	if v.IsSet("Weight") {
+		weight = v.GetInt("Weight")
+	}
+	if weight < 1 {
+		return nil, errors.New("Weight of job " + name + " must be at least 1, got " + strconv.Itoa(weight))
+	}
+	if _, ok := findJob(name); ok {
+		return nil, errors.New("Job " + name + " already exists")
+	}
+	job := &Job{
+		Name:        name,
+		Priority:    v.GetInt("Priority"),
+		Weight:      weight,
+		Status:      "READY",
+		config:      v,
+		settings:    defaultSettings,
+		ClientPath:  client_file,
+		ServerPath:  server_file,
+		CodeVersion: 1,
+		binaries:    make(map[string][]byte),
+		finished:    make(chan bool, 1),
+	}
+	return job, nil
+}
+
+// Load reads the client code, builds and loads the plugin and restores the journal
+func (job *Job) Load() error {
+	code, filename, err := readClientCode(job.ClientPath)
+	if err != nil {
+		return err
+	}
+	source, err := ioutil.ReadFile(job.ServerPath)
+	if err != nil {
+		return err
+	}
+	out, err := buildServer(job.ServerPath, job.pluginFile(job.CodeVersion))
+	if err != nil {
+		return err
+	}
+	GetServer, vars, err := openPlugin(out)
+	if err != nil {
+		return err
+	}
+	err = job.initPluginStruct(GetServer)
+	if err != nil {
+		return err
+	}
+	job.sched = NewScheduler(job)
+	settings, err := job.buildSettings(vars)
+	if err != nil {
+		return err
+	}
+	job.applySettings(vars, settings)
+	job.ClientFile = code
+	job.Filename = filename
+	job.clientHash = hashCode(code)
+	job.serverHash = hashCode(source)
+	return job.initJournal(job.config.GetString("JournalFile"))
+}
+
+// pluginFile returns the file name of the built plugin. Each version gets its own file, since a loaded plugin can't be replaced
+func (job *Job) pluginFile(version int) string {
+	return "build_" + job.Name + "_" + strconv.Itoa(version) + ".so"
+}
+
+// addJob registers the loaded job and assigns its ID, so its WUs are sent to the nodes
+func addJob(job *Job) error {
+	mut.Lock()
+	for _, j := range Jobs {
+		if j.Name == job.Name {
+			mut.Unlock()
+			return errors.New("Job " + job.Name + " already exists")
+		}
+	}
+	job.ID = len(Jobs) + 1
+	Jobs = append(Jobs, job)
+	for _, cl := range Clients {
+		// The broken clients may compute the new job
+		updateBroken(cl)
+	}
+	mut.Unlock()
+	wg.Add(1)
+	go job.handleFinish()
+	printSuccess("Job " + strconv.Itoa(job.ID) + " (" + job.Name + ") is added, priority " + strconv.Itoa(job.Priority) + ", weight " + strconv.Itoa(job.Weight))
+	return nil
+}
+
+// GetJob returns the job by ID
+func GetJob(ID int) (*Job, bool) {
+	mut.Lock()
+	defer mut.Unlock()
+	for _, job := range Jobs {
+		if job.ID == ID {
+			return job, true
+		}
+	}
+	return nil, false
+}
+
+// findJob returns the job by name
+func findJob(name string) (*Job, bool) {
+	mut.Lock()
+	defer mut.Unlock()
+	for _, job := range Jobs {
+		if job.Name == name {
+			return job, true
+		}
+	}
+	return nil, false
+}
+
+// allJobs returns a copy of Jobs, so the caller does not hold mut
+func allJobs() []*Job {
+	mut.Lock()
+	defer mut.Unlock()
+	return append([]*Job{}, Jobs...)
+}
+
+// jobsFor returns the jobs which may send a WU to the client, in the order they are tried:
+// by priority, then the job with the least running WUs per weight goes first
+func jobsFor(client *Client) []*Job {
+	jobs := make([]*Job, 0)
+	mut.Lock()
+	for _, job := range Jobs {
+		if !job.active() || job.Status == "PAUSED" || job.brokenOn(client) {
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+	mut.Unlock()
+	running := make(map[*Job]int)
+	for _, job := range jobs {
+		running[job], _, _ = job.sched.Counts()
+	}
+	sort.SliceStable(jobs, func(i, j int) bool {
+		a, b := jobs[i], jobs[j]
+		if a.Priority != b.Priority {
+			return a.Priority > b.Priority
+		}
+		return running[a]*b.Weight < running[b]*a.Weight
+	})
+	return jobs
+}
+
+// active checks if the job may still get WUs computed. Must be called with mut held
+func (job *Job) active() bool {
+	return job.Status != "FINISH" && job.Status != "CANCELED"
+}
+
+// brokenOn checks if the client could not build the current code of the job. Must be called with mut held
+func (job *Job) brokenOn(client *Client) bool {
+	b, ok := client.Broken[job.ID]
+	return ok && b.Version == job.CodeVersion
+}
+
+// countNodes returns the amount of the connected clients which may compute the job's WUs
+func (job *Job) countNodes() int {
+	mut.Lock()
+	defer mut.Unlock()
+	n := 0
+	for _, cl := range Clients {
+		if cl.Status != "lost" && cl.Status != "failed" && cl.Status != "broken" && !job.brokenOn(cl) {
+			n++
+		}
+	}
+	return n
+}
+
+// updateBroken marks the client as broken if it can't compute any of the active jobs. Must be called with mut held
+func updateBroken(client *Client) {
+	broken := false
+	for _, job := range Jobs {
+		if !job.active() {
+			continue
+		}
+		if !job.brokenOn(client) {
+			broken = false
+			break
+		}
+		broken = true
+	}
+	if broken && client.Status != "lost" {
+		client.Status = "broken"
+	} else if !broken && client.Status == "broken" {
+		client.Status = "ready"
+	}
+}
+
+// exhaust is called when the plugin has no more WUs, the job is finished once the running WUs are done
+func (job *Job) exhaust(err error) {
+	mut.Lock()
+	first := !job.exhausted
+	job.exhausted = true
+	mut.Unlock()
+	if !first {
+		return
+	}
+	printErr("Job " + job.Name + ": " + err.Error()) // No more WUs, finishing...
+	select {
+	case job.finished <- true:
+	default:
+	}
+}
+
+// isExhausted checks if the plugin has no more WUs
+func (job *Job) isExhausted() bool {
+	mut.Lock()
+	defer mut.Unlock()
+	return job.exhausted
+}
+
+// updateStatus sets the status of the job according to its WUs
+func (job *Job) updateStatus() {
+	running, pending, dead := job.sched.Counts()
+	mut.Lock()
+	defer mut.Unlock()
+	if !job.active() || job.Status == "PAUSED" {
+		return
+	}
+	if running != 0 || pending != 0 {
+		job.Status = "RUNNING"
+	} else if dead != 0 {
+		job.Status = "FAILED"
+	}
+}
+
+// Pause stops sending the WUs of the job, the running ones are still collected
+func (job *Job) Pause() error {
+	mut.Lock()
+	if !job.active() {
+		mut.Unlock()
+		return errors.New("Job " + job.Name + " can't be paused, it is " + job.Status)
+	}
+	job.Status = "PAUSED"
+	mut.Unlock()
+	printWarn("Job " + job.Name + " is paused")
+	return nil
+}
+
+// Resume sends the WUs of the paused job again
+func (job *Job) Resume() error {
+	mut.Lock()
+	if job.Status != "PAUSED" {
+		mut.Unlock()
+		return errors.New("Job " + job.Name + " is not paused")
+	}
+	job.Status = "READY"
+	mut.Unlock()
+	printSuccess("Job " + job.Name + " is resumed")
+	return nil
+}
+
+// Cancel stops the job without processing it. The results of the running WUs are ignored,
+// the journal is kept, so the job may be submitted again to resume it
+func (job *Job) Cancel() error {
+	mut.Lock()
+	if !job.active() {
+		mut.Unlock()
+		return errors.New("Job " + job.Name + " can't be canceled, it is " + job.Status)
+	}
+	job.Status = "CANCELED"
+	for _, cl := range Clients {
+		updateBroken(cl)
+	}
+	mut.Unlock()
+	err := job.journal.Close()
+	if err != nil {
+		printErr(err.Error())
+	}
+	printWarn("Job " + job.Name + " is canceled")
+	select {
+	case job.finished <- true:
+	default:
+	}
+	return nil
+}
+
+// FinishNow makes the finishing job stop waiting for the running WUs
+func (job *Job) FinishNow() error {
+	mut.Lock()
+	defer mut.Unlock()
+	if !job.finishing {
+		return errors.New("Job " + job.Name + " is not waiting for its WUs")
+	}
+	job.finishNow = true
+	return nil
+}
+
+// takeFinishNow checks if the job is finished from the dashboard
+func (job *Job) takeFinishNow() bool {
+	mut.Lock()
+	defer mut.Unlock()
+	now := job.finishNow
+	job.finishNow = false
+	return now
+}
+
+func (job *Job) setFinishing(finishing bool) {
+	mut.Lock()
+	job.finishing = finishing
+	mut.Unlock()
+}
+
+// isCanceled checks if the job is canceled
+func (job *Job) isCanceled() bool {
+	mut.Lock()
+	defer mut.Unlock()
+	return job.Status == "CANCELED"
+}
+
+// serverStatus returns the status of the whole server: running if any job is running, finished if all are
+func serverStatus() string {
+	mut.Lock()
+	defer mut.Unlock()
+	count := make(map[string]int)
+	for _, job := range Jobs {
+		count[job.Status]++
+	}
+	switch {
+	case count["RUNNING"] != 0:
+		return "RUNNING"
+	case count["FAILED"] != 0:
+		return "FAILED"
+	case len(Jobs) != 0 && count["FINISH"]+count["CANCELED"] == len(Jobs):
+		return "FINISH"
+	}
+	return "READY"
+}
+
+// initJobs loads the job described at the top of the config file and the ones from its Jobs list.
+// The WUs from the resume file are re-queued to the first job
+func initJobs(v *viper.Viper, client_file, server_file, resume string) error {
+	configs, err := jobConfigs(v)
+	if err != nil {
+		return err
+	}
+	job, err := NewJob(v, client_file, server_file)
+	if err != nil {
+		return err
+	}
+	err = job.Load()
+	if err != nil {
+		return err
+	}
+	if resume != "" {
+		err = job.resumeJob(resume)
+		if err != nil {
+			return err
+		}
+	}
+	err = addJob(job)
+	if err != nil {
+		return err
+	}
+	for _, jv := range configs {
+		job, err := NewJob(jv, jv.GetString("ClientFile"), jv.GetString("ServerFile"))
+		if err != nil {
+			return err
+		}
+		err = job.Load()
+		if err != nil {
+			return errors.New("Could not load job " + job.Name + ": " + err.Error())
+		}
+		err = addJob(job)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// jobConfigs returns the config of each job from the Jobs list of the config file
+func jobConfigs(v *viper.Viper) ([]*viper.Viper, error) {
+	list, ok := v.Get("Jobs").([]interface{})
+	if !ok {
+		if v.IsSet("Jobs") {
+			return nil, errors.New("Jobs in the config file must be a list")
+		}
+		return nil, nil
+	}
+	configs := make([]*viper.Viper, 0, len(list))
+	for i, item := range list {
+		fields, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("Job " + strconv.Itoa(i+1) + " in the config file must be an object")
+		}
+		jv := viper.New()
+		for k, val := range fields {
+			jv.Set(k, val)
+		}
+		if jv.GetString("ClientFile") == "" || jv.GetString("ServerFile") == "" {
+			return nil, errors.New("Job " + strconv.Itoa(i+1) + " in the config file must have ClientFile and ServerFile")
+		}
+		setJobDefaults(jv, jv.GetString("ServerFile"))
+		configs = append(configs, jv)
+	}
+	return configs, nil
+}
+
+// setJobDefaults sets the defaults of a job which is not described at the top of the config file
+func setJobDefaults(v *viper.Viper, server_file string) {
+	v.SetDefault("JournalFile", "panchaea_journal_"+jobName(v, server_file)+".jsonl")
+}
+
+// jobName returns the Name from the job's config, the plugin file name without the extension by default
+func jobName(v *viper.Viper, server_file string) string {
+	name := v.GetString("Name")
+	if name == "" {
+		name = strings.TrimSuffix(filepath.Base(server_file), filepath.Ext(server_file))
+	}
+	return name
+}
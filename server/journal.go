@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// JournalRecord is one line of the WU journal. Data is only written with the first record of a WU
+// and Result only with the "completed" one, so later records stay small
+type JournalRecord struct {
+	ID      int
+	Data    []byte `json:",omitempty"`
+	Status  string
+	Attempt int
+	Client  int
+	Thread  int
+	Result  []byte `json:",omitempty"`
+}
+
+// Journal is an append-only log of every WU state change
+type Journal struct {
+	mut      sync.Mutex
+	filename string
+	file     *os.File
+	enc      *json.Encoder
+	closed   bool
+}
+
+func openJournal(filename string) (*Journal, error) {
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &Journal{filename: filename, file: f, enc: json.NewEncoder(f)}, nil
+}
+
+// Write appends the current state of the WU to the journal
+func (j *Journal) Write(rec JournalRecord) error {
+	if j == nil {
+		return nil
+	}
+	j.mut.Lock()
+	defer j.mut.Unlock()
+	if j.closed {
+		// The job is finished or the server is exiting
+		return nil
+	}
+	return j.enc.Encode(&rec)
+}
+
+// Close closes the journal file
+func (j *Journal) Close() error {
+	if j == nil {
+		return nil
+	}
+	j.mut.Lock()
+	defer j.mut.Unlock()
+	if j.closed {
+		return nil
+	}
+	j.closed = true
+	return j.file.Close()
+}
+
+// Archive closes the journal and renames it, so the next run starts a new job
+func (j *Journal) Archive() error {
+	if j == nil {
+		return nil
+	}
+	err := j.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(j.filename, j.filename+".done")
+}
+
+// readJournal replays the journal and returns the last known state of every WU
+func readJournal(filename string) ([]JournalRecord, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	records := make([]JournalRecord, 0)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		var rec JournalRecord
+		err := json.Unmarshal(scanner.Bytes(), &rec)
+		if err != nil {
+			// The last line may be cut off by a crash
+			printWarn("Skipping broken journal record on line " + strconv.Itoa(line))
+			continue
+		}
+		if rec.ID < 0 {
+			continue
+		}
+		for rec.ID >= len(records) {
+			records = append(records, JournalRecord{ID: len(records), Status: "unknown"})
+		}
+		last := &records[rec.ID]
+		if rec.Data != nil {
+			last.Data = rec.Data
+		}
+		if rec.Result != nil {
+			last.Result = rec.Result
+		}
+		last.Status = rec.Status
+		last.Attempt = rec.Attempt
+		last.Client = rec.Client
+		last.Thread = rec.Thread
+	}
+	return records, scanner.Err()
+}
+
+// restoreWorkUnits re-registers the WUs from the previous run. Completed, dead and invalid WUs are kept as is,
+// the rest are queued to be sent again. The IDs are kept if the records come from the current journal
+func (job *Job) restoreWorkUnits(records []JournalRecord, keepID bool) (int, int) {
+	queued := 0
+	completed := 0
+	for _, rec := range records {
+		if rec.Data == nil {
+			continue
+		}
+		wu := &WorkUnit{ID: rec.ID, Data: rec.Data, Timeout: job.wuTimeout(rec.Data), Status: rec.Status, Attempt: rec.Attempt, Result: rec.Result}
+		switch rec.Status {
+		case "completed":
+			completed++
+		case "dead", "invalid":
+		default:
+			wu.Status = "queued"
+			queued++
+		}
+		job.sched.Restore(wu, keepID, !keepID)
+		if wu.Status == "completed" && job.collecting() {
+			// The plugin lost the collected results with the previous run
+			job.collect(wu, rec.Result)
+		}
+		mut.Lock()
+		job.Replayed[string(rec.Data)]++
+		mut.Unlock()
+	}
+	return queued, completed
+}
+
+func (job *Job) initJournal(filename string) error {
+	job.Replayed = make(map[string]int)
+	if filename == "" {
+		printWarn("Journal of job " + job.Name + " is disabled, WUs will be lost on restart")
+		return nil
+	}
+	if _, err := os.Stat(filename); err == nil {
+		records, err := readJournal(filename)
+		if err != nil {
+			return err
+		}
+		queued, completed := job.restoreWorkUnits(records, true)
+		printSuccess("Journal (" + filename + ") is restored: " + strconv.Itoa(completed) + " completed and " + strconv.Itoa(queued) + " queued WUs")
+	}
+	j, err := openJournal(filename)
+	if err != nil {
+		return err
+	}
+	job.journal = j
+	return nil
+}
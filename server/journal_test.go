@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "panchaea")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "journal")
+	j, err := openJournal(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := []JournalRecord{
+		{ID: 1, Data: []byte("one"), Status: "new", Client: 1},
+		{ID: 2, Data: []byte("two"), Status: "new", Client: 2},
+		{ID: 1, Status: "failed", Client: 1},
+		{ID: 1, Status: "running", Attempt: 1, Client: 3, Thread: 2},
+		{ID: 2, Status: "completed", Client: 2, Result: []byte("res")},
+	}
+	for _, rec := range records {
+		if err := j.Write(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	j.Close()
+	// The server has crashed in the middle of a record
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"ID":1,"Status":"comp`)
+	f.Close()
+
+	got, err := readJournal(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []JournalRecord{
+		{ID: 0, Status: "unknown"},
+		{ID: 1, Data: []byte("one"), Status: "running", Attempt: 1, Client: 3, Thread: 2},
+		{ID: 2, Data: []byte("two"), Status: "completed", Client: 2, Result: []byte("res")},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("readJournal = %d records, want %d", len(got), len(want))
+	}
+	for i := range want {
+		g, w := got[i], want[i]
+		if g.ID != w.ID || string(g.Data) != string(w.Data) || g.Status != w.Status || g.Attempt != w.Attempt ||
+			g.Client != w.Client || g.Thread != w.Thread || string(g.Result) != string(w.Result) {
+			t.Errorf("record %d = %+v, want %+v", i, g, w)
+		}
+	}
+}
@@ -0,0 +1,16 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"regexp"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	// main sets these up before anything is printed
+	reg = regexp.MustCompile(`[\[]+(\w|\W)+[\]]+\s*\w*`)
+	log.SetOutput(ioutil.Discard)
+	os.Exit(m.Run())
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// packModule packs the worker's module directory into a tar.gz archive, so the nodes get all its files
+// and the vendored dependencies
+func packModule(dir string) ([]byte, error) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	files := 0
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if name == "." {
+			return nil
+		}
+		// Only the top-level build directory has the outputs, a package may be named build too
+		if info.IsDir() && (info.Name() == ".git" || name == "build") {
+			return filepath.SkipDir
+		}
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			printWarn("Skipping " + path + ": not a regular file")
+			return nil
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(name)
+		err = tw.WriteHeader(hdr)
+		if err != nil || info.IsDir() {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		files++
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = tw.Close()
+	if err != nil {
+		return nil, err
+	}
+	err = gz.Close()
+	if err != nil {
+		return nil, err
+	}
+	printSuccess("Module is packed: " + strconv.Itoa(files) + " files, " + strconv.Itoa(buf.Len()) + " bytes")
+	return buf.Bytes(), nil
+}
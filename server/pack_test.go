@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go-panchaea/internal/modpack"
+)
+
+func TestPackModule(t *testing.T) {
+	dir, err := ioutil.TempDir("", "panchaea")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]bool{
+		"go.mod":              true,
+		"main.go":             true,
+		"internal/build/b.go": true,
+		"build/cache/worker":  false,
+		".git/HEAD":           false,
+		"vendor/m/.git/HEAD":  false,
+	}
+	for name := range files {
+		if err := modpack.WriteFile(filepath.Join(dir, filepath.FromSlash(name)), bytes.NewReader([]byte("package main\n")), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := packModule(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := filepath.Join(dir, "unpacked")
+	if err := modpack.Unpack(data, target); err != nil {
+		t.Fatal(err)
+	}
+	for name, packed := range files {
+		_, err := os.Stat(filepath.Join(target, filepath.FromSlash(name)))
+		if packed && err != nil {
+			t.Errorf("%s is not packed: %v", name, err)
+		} else if !packed && err == nil {
+			t.Errorf("%s is packed", name)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Policy replaces the questions the server asks on the console, so it may run headless
+type Policy struct {
+	Headless     bool   // Nothing is read from the console
+	FinishPolicy string // "ask", "wait", "ignore-stuck" or "timeout=<duration>"
+	DumpOnExit   string // "ask", "always" or "never"
+
+	finishAfter time.Duration // Parsed from "timeout=<duration>"
+}
+
+// policy is guarded by mut
+var policy Policy
+
+// parseFinishPolicy checks the finish policy and returns the timeout of the "timeout=<duration>" one
+func parseFinishPolicy(s string) (time.Duration, error) {
+	switch s {
+	case "ask", "wait", "ignore-stuck":
+		return 0, nil
+	}
+	if strings.HasPrefix(s, "timeout=") {
+		d, err := time.ParseDuration(strings.TrimPrefix(s, "timeout="))
+		if err != nil || d <= 0 {
+			return 0, errors.New("Finish timeout must be a positive duration (e.g. \"timeout=30m\"), got \"" + s + "\"")
+		}
+		return d, nil
+	}
+	return 0, errors.New("FinishPolicy must be \"ask\", \"wait\", \"ignore-stuck\" or \"timeout=<duration>\", got \"" + s + "\"")
+}
+
+// newPolicy validates the policies, "ask" is not allowed in the headless mode
+func newPolicy(headless bool, finish, dump string) (Policy, error) {
+	p := Policy{Headless: headless, FinishPolicy: finish, DumpOnExit: dump}
+	var err error
+	p.finishAfter, err = parseFinishPolicy(finish)
+	if err != nil {
+		return p, err
+	}
+	if dump != "ask" && dump != "always" && dump != "never" {
+		return p, errors.New("DumpOnExit must be \"ask\", \"always\" or \"never\", got \"" + dump + "\"")
+	}
+	if headless && (finish == "ask" || dump == "ask") {
+		return p, errors.New("The server can't ask in the headless mode, set FinishPolicy and DumpOnExit")
+	}
+	return p, nil
+}
+
+// initPolicy reads the policies from the config file and the flags, the flags take precedence.
+// By default the server asks, and does what the default answers do in the headless mode
+func initPolicy(v *viper.Viper) error {
+	quiet := v.GetBool("Headless") || *headless
+	finish, dump := v.GetString("FinishPolicy"), v.GetString("DumpOnExit")
+	if *finish_policy != "" {
+		finish = *finish_policy
+	}
+	if *dump_on_exit != "" {
+		dump = *dump_on_exit
+	}
+	if finish == "" {
+		finish = "ask"
+		if quiet {
+			finish = "ignore-stuck"
+		}
+	}
+	if dump == "" {
+		dump = "ask"
+		if quiet {
+			dump = "always"
+		}
+	}
+	p, err := newPolicy(quiet, finish, dump)
+	if err != nil {
+		return err
+	}
+	setPolicy(p)
+	if quiet {
+		printSuccess("Headless mode: finish policy " + p.FinishPolicy + ", dump on exit " + p.DumpOnExit)
+	}
+	return nil
+}
+
+func getPolicy() Policy {
+	mut.Lock()
+	defer mut.Unlock()
+	return policy
+}
+
+func setPolicy(p Policy) {
+	mut.Lock()
+	policy = p
+	mut.Unlock()
+}
+
+// ask prints the question and reads the answer from the console
+func ask(question string) string {
+	tmp := ""
+	printWarn(question)
+	fmt.Print("    ")
+	fmt.Scanln(&tmp)
+	return tmp
+}
+
+// stopWaiting decides if the job is finished without the WUs which are still computed on alive clients
+// or stuck on lost ones. It is called every second, tick counts the calls
+func (job *Job) stopWaiting(computing, stuck, tick int, waited time.Duration) bool {
+	if job.takeFinishNow() {
+		printWarn("Job " + job.Name + " is finished from the dashboard without " + strconv.Itoa(computing+stuck) + " WUs")
+		return true
+	}
+	p := getPolicy()
+	switch p.FinishPolicy {
+	case "wait":
+		return false
+	case "ignore-stuck":
+		return computing == 0
+	case "ask":
+		if computing == 0 {
+			tmp := ask("Job " + job.Name + ": there are " + strconv.Itoa(stuck) + " WUs on stuck clients, ignore them and finish the job? [Y/n]")
+			return tmp != "n" && tmp != "N"
+		}
+		if tick%100 == 0 {
+			tmp := ask("Job " + job.Name + ": clients may be stuck, ignore and finish the job? [y/N]")
+			return tmp == "y" || tmp == "Y"
+		}
+		return false
+	}
+	if waited < p.finishAfter {
+		return false
+	}
+	printWarn("Job " + job.Name + ": waited " + p.finishAfter.String() + ", finishing without " + strconv.Itoa(computing+stuck) + " WUs")
+	return true
+}
+
+// dumpOnExit decides if the WUs are written to the log on exit
+func dumpOnExit(lines int) bool {
+	switch getPolicy().DumpOnExit {
+	case "always":
+		return true
+	case "never":
+		return false
+	}
+	tmp := ask("[!] Dump WUs data to the log (" + strconv.Itoa(lines) + " lines)? [Y/n]")
+	return tmp != "n" && tmp != "N"
+}
+
+// handlePolicy shows the policies on GET and changes them on POST, the form values are FinishPolicy and DumpOnExit
+func handlePolicy(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, getPolicy())
+	case http.MethodPost:
+		p := getPolicy()
+		finish, dump := p.FinishPolicy, p.DumpOnExit
+		if val := r.FormValue("FinishPolicy"); val != "" {
+			finish = val
+		}
+		if val := r.FormValue("DumpOnExit"); val != "" {
+			dump = val
+		}
+		p, err := newPolicy(p.Headless, finish, dump)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		setPolicy(p)
+		printWarn("Finish policy is set to " + p.FinishPolicy + ", dump on exit to " + p.DumpOnExit)
+		writeJSON(w, http.StatusOK, p)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
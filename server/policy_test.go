@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseFinishPolicy(t *testing.T) {
+	tests := []struct {
+		policy string
+		want   time.Duration
+		ok     bool
+	}{
+		{"ask", 0, true},
+		{"wait", 0, true},
+		{"ignore-stuck", 0, true},
+		{"timeout=30m", 30 * time.Minute, true},
+		{"timeout=1h30m", 90 * time.Minute, true},
+		{"timeout=0s", 0, false},
+		{"timeout=-5m", 0, false},
+		{"timeout=soon", 0, false},
+		{"timeout", 0, false},
+		{"", 0, false},
+		{"Wait", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := parseFinishPolicy(tt.policy)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseFinishPolicy(%q) = %v, %v, want %v (ok: %v)", tt.policy, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestNewPolicy(t *testing.T) {
+	tests := []struct {
+		headless     bool
+		finish, dump string
+		ok           bool
+	}{
+		{false, "ask", "ask", true},
+		{true, "wait", "always", true},
+		{true, "ask", "never", false},
+		{true, "wait", "ask", false},
+		{false, "wait", "sometimes", false},
+	}
+	for _, tt := range tests {
+		_, err := newPolicy(tt.headless, tt.finish, tt.dump)
+		if (err == nil) != tt.ok {
+			t.Errorf("newPolicy(%v, %q, %q) = %v, want ok: %v", tt.headless, tt.finish, tt.dump, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// Version is the Panchaea release of the server, the nodes report theirs on join
+const Version = "0.5.0"
+
+// NodeInfo describes the machine of the node, it is reported with "hello"
+type NodeInfo struct {
+	Hostname string
+	OS       string
+	Arch     string
+	CPUs     int
+	Version  string // Panchaea release of the node
+}
+
+// NodeRecord is a node with a persistent identity
+type NodeRecord struct {
+	ID     int
+	Node   NodeInfo
+	Joined time.Time // Last time the node joined
+}
+
+// Registry issues the node IDs, which are never reused. Nodes with a key file keep their ID,
+// the registry is saved so they keep it after the server is restarted too
+type Registry struct {
+	NextID int
+	Nodes  map[string]*NodeRecord // By the hash of the node key
+
+	filename string
+}
+
+// registry is guarded by mut
+var registry = Registry{NextID: 1, Nodes: make(map[string]*NodeRecord)}
+
+// loadRegistry reads the registry from the file, if it exists
+func loadRegistry(filename string) error {
+	r := Registry{NextID: 1, Nodes: make(map[string]*NodeRecord), filename: filename}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &r)
+		if err != nil {
+			return err
+		}
+		if r.Nodes == nil {
+			r.Nodes = make(map[string]*NodeRecord)
+		}
+		for _, rec := range r.Nodes {
+			if rec.ID >= r.NextID {
+				r.NextID = rec.ID + 1
+			}
+		}
+	}
+	mut.Lock()
+	registry = r
+	mut.Unlock()
+	return nil
+}
+
+// save writes the registry to a temporary file and replaces the old one, so it is never left half-written
+func (r *Registry) save() error {
+	if r.filename == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(r, "", "    ")
+	if err != nil {
+		return err
+	}
+	tmp := r.filename + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.filename)
+}
+
+// issueID returns the ID of the node which has joined. A node with a known key gets its previous ID back,
+// the others get a new one. known is false for the new nodes
+func issueID(key string, node NodeInfo) (ID int, known bool, err error) {
+	mut.Lock()
+	defer mut.Unlock()
+	hash := ""
+	if key != "" {
+		sum := sha256.Sum256([]byte(key))
+		hash = hex.EncodeToString(sum[:])
+		if rec, ok := registry.Nodes[hash]; ok {
+			rec.Node = node
+			rec.Joined = time.Now()
+			return rec.ID, true, registry.save()
+		}
+	}
+	ID = registry.NextID
+	registry.NextID++
+	if hash != "" {
+		registry.Nodes[hash] = &NodeRecord{ID: ID, Node: node, Joined: time.Now()}
+	}
+	return ID, false, registry.save()
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+)
+
+// handleReload reloads the code of every job each time the server gets SIGHUP
+func handleReload() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	for {
+		select {
+		case <-ctx.Done():
+			signal.Stop(ch)
+			return
+		case <-ch:
+			for _, job := range allJobs() {
+				err := job.reload()
+				if err != nil {
+					printErr("Reload of job " + job.Name + " failed, the previous code is kept: " + err.Error())
+				}
+			}
+		}
+	}
+}
+
+// reload re-reads the client code and rebuilds the plugin if its source is changed, then bumps CodeVersion.
+// Nothing is replaced if the new code can't be loaded
+func (job *Job) reload() error {
+	job.reloadMut.Lock()
+	defer job.reloadMut.Unlock()
+	code, filename, err := readClientCode(job.ClientPath)
+	if err != nil {
+		return err
+	}
+	source, err := ioutil.ReadFile(job.ServerPath)
+	if err != nil {
+		return err
+	}
+	clientHash, serverHash := hashCode(code), hashCode(source)
+	if clientHash == job.clientHash && serverHash == job.serverHash {
+		printSuccess("Job " + job.Name + " is not changed")
+		return nil
+	}
+	printSuccess("Reloading job " + job.Name + "...")
+	mut.Lock()
+	version := job.CodeVersion + 1
+	mut.Unlock()
+	if serverHash != job.serverHash {
+		out, err := buildServer(job.ServerPath, job.pluginFile(version))
+		if err != nil {
+			return err
+		}
+		GetServer, vars, err := openPlugin(out)
+		if err != nil {
+			return err
+		}
+		err = job.swapPlugin(GetServer, vars)
+		if err != nil {
+			return err
+		}
+		job.serverHash = serverHash
+	}
+	job.binMut.Lock()
+	job.binaries = make(map[string][]byte)
+	job.binMut.Unlock()
+	mut.Lock()
+	job.ClientFile = code
+	job.Filename = filename
+	job.CodeVersion = version
+	for _, cl := range Clients {
+		// The broken nodes try the new code
+		updateBroken(cl)
+	}
+	mut.Unlock()
+	job.clientHash = clientHash
+	printSuccess("Job " + job.Name + ": code version " + strconv.Itoa(version) + " is loaded, the nodes fetch it with their next WU")
+	return nil
+}
+
+// swapPlugin replaces the running plugin of the job. Like after a restart, the WUs it generates again are skipped
+// and the completed results are collected again. The running plugin is kept if the settings of the new one are invalid
+func (job *Job) swapPlugin(GetServer func() interface{}, vars pluginVars) error {
+	servInter := GetServer()
+	s, ok := servInter.(Server)
+	if !ok {
+		return errors.New("Could not receive the server interface!")
+	}
+	job.servMut.Lock()
+	defer job.servMut.Unlock()
+	// The plugin may set its settings in Init
+	s.Init()
+	settings, err := job.buildSettings(vars)
+	if err != nil {
+		return errors.New("Settings of the new plugin are invalid: " + err.Error())
+	}
+	hadCollector := job.collecting()
+	job.serv = s
+	job.initHooks(servInter)
+	job.applySettings(vars, settings)
+	units := job.sched.All()
+	mut.Lock()
+	job.Replayed = make(map[string]int)
+	for _, wu := range units {
+		job.Replayed[string(wu.Data)]++
+	}
+	mut.Unlock()
+	collecting := job.collecting()
+	job.sched.SetKeep(!collecting)
+	if collecting {
+		job.recollect(units)
+	} else if hadCollector {
+		printWarn("The results collected by the previous plugin are not passed to Process")
+	}
+	return nil
+}
+
+// recollect passes the completed results to the new plugin, reading them from the journal if they are not kept in memory
+func (job *Job) recollect(units []WorkUnit) {
+	var records []JournalRecord
+	if job.journal != nil {
+		var err error
+		records, err = readJournal(job.journal.filename)
+		if err != nil {
+			printErr("Could not read the journal: " + err.Error())
+		}
+	}
+	lost := 0
+	for i := range units {
+		if units[i].Status != "completed" {
+			continue
+		}
+		wu, ok := job.sched.Get(units[i].ID)
+		if !ok {
+			continue
+		}
+		result := units[i].Result
+		if result == nil && wu.ID < len(records) {
+			result = records[wu.ID].Result
+		}
+		if result == nil {
+			lost++
+			continue
+		}
+		job.collect(wu, result)
+	}
+	if lost != 0 {
+		printWarn(strconv.Itoa(lost) + " completed result(s) are not in memory nor in the journal and are not collected again")
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var logPrefix = regexp.MustCompile(`^\[server\]\d{2}:\d{2}:\d{2} `)
+
+var dumpHeader = regexp.MustCompile(`WU, id: (\d+)(?:, job: ([^;]+))?`)
+
+// isJournal checks if the file is a journal rather than a log dump
+func isJournal(filename string) (bool, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" {
+			return strings.HasPrefix(line, "{"), nil
+		}
+	}
+	return false, scanner.Err()
+}
+
+// readDump parses the "[start JSON data]" blocks of the job written by handleCleanExit and Finish.
+// Only the latest dump in the log is taken, blocks without the job name are taken for any job
+func readDump(filename, name string) ([]JournalRecord, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	records := make([]JournalRecord, 0)
+	var current *JournalRecord
+	var buf []string
+	mode := ""
+	lastID := -1
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024*1024)
+	for scanner.Scan() {
+		line := logPrefix.ReplaceAllString(scanner.Text(), "")
+		switch {
+		case strings.Contains(line, "[start JSON data]"), strings.Contains(line, "[start JSON result]"):
+			mode = "data"
+			if strings.Contains(line, "result") {
+				mode = "result"
+			}
+			buf = buf[:0]
+		case strings.Contains(line, "[end JSON data]"), strings.Contains(line, "[end JSON result]"):
+			if current != nil {
+				block := bytes.TrimSpace([]byte(strings.Join(buf, "\n")))
+				if mode == "data" {
+					current.Data = block
+				} else if len(block) != 0 {
+					current.Result = block
+					current.Status = "completed"
+				}
+			}
+			mode = ""
+		case mode != "":
+			buf = append(buf, line)
+		case strings.HasPrefix(line, "[E]") && dumpHeader.MatchString(line):
+			match := dumpHeader.FindStringSubmatch(line)
+			if match[2] != "" && match[2] != name {
+				// Another job's WU
+				current = nil
+				continue
+			}
+			id, err := strconv.Atoi(match[1])
+			if err != nil {
+				return nil, err
+			}
+			if id <= lastID {
+				// A new dump starts, the previous one is outdated
+				records = records[:0]
+			}
+			lastID = id
+			records = append(records, JournalRecord{Status: "queued"})
+			current = &records[len(records)-1]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	res := make([]JournalRecord, 0, len(records))
+	for _, rec := range records {
+		if len(rec.Data) != 0 {
+			res = append(res, rec)
+		}
+	}
+	return res, nil
+}
+
+// resumeJob re-queues the WUs from a log dump or a journal before the plugin is asked for new ones
+func (job *Job) resumeJob(filename string) error {
+	if job.journal != nil && filename == job.journal.filename {
+		return errors.New("The journal is already restored, no need to resume from it")
+	}
+	ok, err := isJournal(filename)
+	if err != nil {
+		return err
+	}
+	var records []JournalRecord
+	if ok {
+		records, err = readJournal(filename)
+	} else {
+		records, err = readDump(filename, job.Name)
+	}
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		return errors.New("No WUs found in " + filename)
+	}
+	queued, completed := job.restoreWorkUnits(records, false)
+	printSuccess("Resumed from " + filename + ": " + strconv.Itoa(completed) + " completed and " + strconv.Itoa(queued) + " queued WUs")
+	return nil
+}
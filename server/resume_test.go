@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeDump writes the WUs to the log file like the server does on exit
+func writeDump(t *testing.T, filename string, dumps ...func()) {
+	f, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	log.SetOutput(f)
+	log.SetPrefix("[server]")
+	log.SetFlags(log.Ltime)
+	defer func() {
+		log.SetOutput(ioutil.Discard)
+		log.SetPrefix("")
+		log.SetFlags(log.LstdFlags)
+	}()
+	for _, dump := range dumps {
+		dump()
+	}
+}
+
+func TestReadDump(t *testing.T) {
+	dir, err := ioutil.TempDir("", "panchaea")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "panchaea.log")
+	job := &Job{Name: "pi"}
+	other := &Job{Name: "other"}
+	writeDump(t, filename,
+		// An older dump, replaced by the next one
+		func() {
+			logWorkUnit("Unfinished", job, WorkUnit{ID: 1, Data: []byte(`"old"`)}, false)
+		},
+		func() {
+			log.Println("Job pi is interrupted")
+			logWorkUnit("Unfinished", job, WorkUnit{ID: 1, Data: []byte(`{"n": 1}`)}, false)
+			logWorkUnit("Unfinished", other, WorkUnit{ID: 2, Data: []byte(`"other"`)}, false)
+			logWorkUnit("Completed", job, WorkUnit{ID: 3, Data: []byte("[\n  3\n]"), Result: []byte(`"done"`)}, true)
+		},
+	)
+
+	got, err := readDump(filename, "pi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []JournalRecord{
+		{Data: []byte(`{"n": 1}`), Status: "queued"},
+		{Data: []byte("[\n  3\n]"), Status: "completed", Result: []byte(`"done"`)},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("readDump = %+v, want %d records", got, len(want))
+	}
+	for i := range want {
+		g, w := got[i], want[i]
+		if string(g.Data) != string(w.Data) || g.Status != w.Status || string(g.Result) != string(w.Result) {
+			t.Errorf("record %d = %+v, want %+v", i, g, w)
+		}
+	}
+	if ok, err := isJournal(filename); err != nil || ok {
+		t.Errorf("isJournal = %v, %v, want a log dump", ok, err)
+	}
+}
@@ -0,0 +1,654 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Scheduler keeps all WUs of the job and decides which one is sent next.
+// Every WU field and the job settings are guarded by its lock. The lock may be held while taking mut or the job's hookMut, never the other way
+type Scheduler struct {
+	mut      sync.Mutex
+	units    map[int]*WorkUnit         // All WUs and their copies by ID
+	order    []*WorkUnit               // Original WUs in the order of registration
+	pending  []*WorkUnit               // Queued, failed and stuck WUs waiting to be sent, nil if taken
+	head     int                       // First element of pending
+	base     int                       // Position of pending[0] since the start, the positions never change
+	queued   int                       // WUs in pending
+	cursor   map[int]int               // By client ID, the client can't take any WU before this position
+	running  map[int]*WorkUnit         // Running WUs by ID
+	byClient map[int]map[int]*WorkUnit // Running WUs by client ID and WU ID
+	dead     int
+	nextID   int
+	keep     bool // Keep the results in memory, false if the plugin collects them
+	job      *Job
+}
+
+// NewScheduler creates an empty scheduler of the job
+func NewScheduler(job *Job) *Scheduler {
+	return &Scheduler{
+		units:    make(map[int]*WorkUnit),
+		order:    make([]*WorkUnit, 0),
+		pending:  make([]*WorkUnit, 0),
+		cursor:   make(map[int]int),
+		running:  make(map[int]*WorkUnit),
+		byClient: make(map[int]map[int]*WorkUnit),
+		nextID:   1,
+		keep:     !job.collecting(),
+		job:      job,
+	}
+}
+
+// Vote is the result of the WU computed by one client
+type Vote struct {
+	Client *Client
+	Result []byte
+}
+
+func (s *Scheduler) push(wu *WorkUnit) {
+	if wu.pending {
+		return
+	}
+	wu.pending = true
+	wu.slot = s.base + len(s.pending)
+	s.pending = append(s.pending, wu)
+	s.queued++
+}
+
+// remove takes the WU out of the queue
+func (s *Scheduler) remove(wu *WorkUnit) {
+	if !wu.pending {
+		return
+	}
+	wu.pending = false
+	s.pending[wu.slot-s.base] = nil
+	s.queued--
+	for s.head < len(s.pending) && s.pending[s.head] == nil {
+		s.head++
+	}
+}
+
+// compact drops the taken WUs from the start of the queue, the positions of the rest are kept
+func (s *Scheduler) compact() {
+	if s.head == len(s.pending) {
+		s.base += s.head
+		s.pending = s.pending[:0]
+		s.head = 0
+	} else if s.head > 1024 && s.head*2 > len(s.pending) {
+		s.base += s.head
+		n := copy(s.pending, s.pending[s.head:])
+		for i := n; i < len(s.pending); i++ {
+			s.pending[i] = nil
+		}
+		s.pending = s.pending[:n]
+		s.head = 0
+	}
+}
+
+// start marks the WU as running on its client
+func (s *Scheduler) start(wu *WorkUnit) {
+	s.running[wu.ID] = wu
+	units, ok := s.byClient[wu.Client.ID]
+	if !ok {
+		units = make(map[int]*WorkUnit)
+		s.byClient[wu.Client.ID] = units
+	}
+	units[wu.ID] = wu
+}
+
+// stop removes the WU from the running ones
+func (s *Scheduler) stop(wu *WorkUnit) {
+	delete(s.running, wu.ID)
+	if wu.Client != nil {
+		delete(s.byClient[wu.Client.ID], wu.ID)
+	}
+}
+
+// save writes the WU state to the journal
+func (s *Scheduler) save(wu *WorkUnit, withData bool) {
+	if s.job.journal == nil || wu.Parent != nil {
+		// Speculative copies are not saved, the original is queued again after the restart
+		return
+	}
+	rec := JournalRecord{ID: wu.ID, Status: wu.Status, Attempt: wu.Attempt, Thread: wu.Thread}
+	if wu.Client != nil {
+		rec.Client = wu.Client.ID
+	}
+	if withData {
+		rec.Data = wu.Data
+	}
+	if wu.Status == "completed" {
+		rec.Result = wu.Result
+	}
+	err := s.job.journal.Write(rec)
+	if err != nil {
+		printErr("Could not write to the journal: " + err.Error())
+	}
+}
+
+// Restore registers the WU from the journal or the log dump
+func (s *Scheduler) Restore(wu *WorkUnit, keepID bool, save bool) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if !keepID {
+		wu.ID = s.nextID
+	}
+	if wu.ID >= s.nextID {
+		s.nextID = wu.ID + 1
+	}
+	s.units[wu.ID] = wu
+	s.order = append(s.order, wu)
+	if wu.Status == "queued" {
+		s.push(wu)
+		s.replicate(wu, s.job.settings.Replication-1)
+	} else if wu.Status == "dead" || wu.Status == "invalid" {
+		s.dead++
+	}
+	if save {
+		s.save(wu, true)
+	}
+	if !s.keep {
+		wu.Result = nil
+	}
+}
+
+// Add registers a new WU and assigns it to the client
+func (s *Scheduler) Add(data []byte, timeout time.Duration, client *Client, thread int) *WorkUnit {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	wu := &WorkUnit{ID: s.nextID, Data: data, Timeout: timeout, Client: client, Thread: thread, Status: "new"}
+	s.nextID++
+	s.units[wu.ID] = wu
+	s.order = append(s.order, wu)
+	s.save(wu, true)
+	s.replicate(wu, s.job.settings.Replication-1)
+	return wu
+}
+
+// replicate queues n replicas of the WU, each of them is sent to a client which has no other replica
+func (s *Scheduler) replicate(root *WorkUnit, n int) {
+	for i := 0; i < n; i++ {
+		rep := &WorkUnit{ID: s.nextID, Data: root.Data, Timeout: root.Timeout, Status: "queued", Parent: root, replica: true}
+		s.nextID++
+		s.units[rep.ID] = rep
+		root.copies = append(root.copies, rep)
+		s.push(rep)
+	}
+}
+
+// computing checks if the WU may still send its result
+func computing(wu *WorkUnit) bool {
+	switch wu.Status {
+	case "completed", "validating", "cancelled", "dead", "invalid":
+		return false
+	}
+	return true
+}
+
+// busy checks if the client has already computed the WU or is computing another replica of it
+func (s *Scheduler) busy(root *WorkUnit, client *Client) bool {
+	if voted(root, client) {
+		return true
+	}
+	running := func(wu *WorkUnit) bool {
+		return wu.Client == client && (wu.Status == "new" || wu.Status == "running" || wu.Status == "unknown")
+	}
+	if running(root) {
+		return true
+	}
+	for _, c := range root.copies {
+		if running(c) {
+			return true
+		}
+	}
+	return false
+}
+
+// voted checks if the client has sent its result of the WU, it never takes another replica of it then
+func voted(root *WorkUnit, client *Client) bool {
+	for _, v := range root.votes {
+		if v.Client == client {
+			return true
+		}
+	}
+	return false
+}
+
+// Next returns the first WU waiting to be sent again and assigns it to the client
+func (s *Scheduler) Next(client *Client, thread int) (*WorkUnit, bool) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.compact()
+	i := s.head
+	if c := s.cursor[client.ID] - s.base; c > i {
+		i = c
+	}
+	// The cursor passes the WUs the client can never take, so they are not scanned on every call
+	advance := true
+	for ; i < len(s.pending); i++ {
+		var next *WorkUnit
+		if wu := s.pending[i]; wu != nil {
+			root := wu
+			if wu.Parent != nil {
+				root = wu.Parent
+			}
+			if computing(wu) && s.job.settings.Replication > 1 && s.busy(root, client) {
+				// The replica waits for another client. A client which computes another replica may still fail it
+				advance = advance && voted(root, client)
+			} else {
+				s.remove(wu)
+				next = s.assign(wu, root, client, thread)
+			}
+		}
+		if advance {
+			s.cursor[client.ID] = s.base + i + 1
+		}
+		if next != nil {
+			return next, true
+		}
+	}
+	return nil, false
+}
+
+// assign gives the WU taken from the queue to the client, it returns nil if the WU is not sent anymore
+func (s *Scheduler) assign(wu, root *WorkUnit, client *Client, thread int) *WorkUnit {
+	switch wu.Status {
+	case "queued":
+	case "stuck", "failed", "timeout", "oom":
+		if wu.Attempt >= s.job.settings.MaxAttempts {
+			s.bury(root)
+			printErr("FATAL: WorkUnit " + strconv.Itoa(root.ID) + " of job " + s.job.Name + " exceeded all " + strconv.Itoa(s.job.settings.MaxAttempts) + " attempt(s)")
+			return nil
+		}
+		if wu.Status == "stuck" && wu.Parent == nil && wu.Client != nil && wu.Client != client && clientAlive(wu.Client) {
+			printWarn("WU " + strconv.Itoa(wu.ID) + " is stuck on client " + strconv.Itoa(wu.Client.ID) + ", sending a copy to client " + strconv.Itoa(client.ID))
+			return s.speculate(wu, client, thread)
+		}
+		wu.Attempt++
+	default:
+		// The WU has changed its status since it was queued
+		return nil
+	}
+	wu.Client = client
+	wu.Thread = thread
+	wu.Status = "new"
+	return wu
+}
+
+// speculate sends a copy of the stuck WU to another client, the first result of the two is taken
+func (s *Scheduler) speculate(root *WorkUnit, client *Client, thread int) *WorkUnit {
+	// The original is still being computed
+	root.Attempt++
+	s.dispatch(root, "running")
+	spec := &WorkUnit{ID: s.nextID, Data: root.Data, Timeout: root.Timeout, Client: client, Thread: thread, Status: "new", Attempt: root.Attempt, Parent: root}
+	s.nextID++
+	s.units[spec.ID] = spec
+	root.copies = append(root.copies, spec)
+	return spec
+}
+
+func (s *Scheduler) dispatch(wu *WorkUnit, status string) {
+	wu.Status = status
+	wu.Time = time.Now()
+	wu.Deadline = time.Time{}
+	if wu.Timeout > 0 {
+		wu.Deadline = wu.Time.Add(wu.Timeout)
+	}
+	s.start(wu)
+	s.save(wu, false)
+}
+
+// Dispatch marks the WU as sent to its client and sets its deadline. It returns the code version the WU is sent with
+func (s *Scheduler) Dispatch(wu *WorkUnit, status string) int {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.dispatch(wu, status)
+	return s.stamp(wu)
+}
+
+// stamp records the code version the WU is sent with
+func (s *Scheduler) stamp(wu *WorkUnit) int {
+	mut.Lock()
+	wu.Version = s.job.CodeVersion
+	mut.Unlock()
+	return wu.Version
+}
+
+// Reload sends the WU to the same client again, it returns the code version like Dispatch
+func (s *Scheduler) Reload(wu *WorkUnit) (int, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if wu.Status == "completed" || wu.Status == "validating" || wu.Status == "cancelled" {
+		return 0, errors.New("Cannot re-upload: the WU is already completed")
+	}
+	if wu.Attempt >= s.job.settings.MaxAttempts || wu.Status == "dead" || wu.Status == "invalid" {
+		return 0, errors.New("Cannot re-upload: too many failed attempts")
+	}
+	wu.Attempt++
+	s.dispatch(wu, "unknown")
+	return s.stamp(wu), nil
+}
+
+// Complete saves the result and returns the original WU with "completed". The status is "ignored" if the WU
+// is already completed by another client or is dead, and "voted" if the result waits for the quorum
+func (s *Scheduler) Complete(wu *WorkUnit, result []byte) (*WorkUnit, string) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	root := wu
+	if wu.Parent != nil {
+		root = wu.Parent
+	}
+	s.stop(wu)
+	if root.Status == "completed" || root.Status == "dead" || root.Status == "invalid" {
+		wu.Status = "completed"
+		return root, "ignored"
+	}
+	wu.Status = "completed"
+	if s.job.settings.Replication > 1 && !s.vote(root, wu, result) {
+		return root, "voted"
+	}
+	root.Status = "completed"
+	root.Result = result
+	root.votes = nil
+	s.stop(root)
+	s.remove(root)
+	s.cancelCopies(root, wu)
+	s.save(root, false)
+	if !s.keep {
+		root.Result = nil
+	}
+	return root, "completed"
+}
+
+// vote records the result of the replica and returns true if the quorum agrees with it. The clients
+// whose results disagree with the accepted one are flagged. Another replica is sent if every replica
+// is computed without the quorum
+func (s *Scheduler) vote(root, wu *WorkUnit, result []byte) bool {
+	if wu == root {
+		root.Status = "validating"
+	}
+	for _, v := range root.votes {
+		if v.Client == wu.Client {
+			return false
+		}
+	}
+	root.votes = append(root.votes, Vote{Client: wu.Client, Result: result})
+	agree := 0
+	for _, v := range root.votes {
+		if s.job.sameResult(v.Result, result) {
+			agree++
+		}
+	}
+	if agree >= s.job.settings.quorum() {
+		for _, v := range root.votes {
+			if !s.job.sameResult(v.Result, result) {
+				mut.Lock()
+				v.Client.Disagreed++
+				mut.Unlock()
+				printWarn("Client " + strconv.Itoa(v.Client.ID) + " disagreed with the quorum on WU " + strconv.Itoa(root.ID) + " of job " + s.job.Name)
+			}
+		}
+		return true
+	}
+	if computing(root) {
+		return false
+	}
+	for _, c := range root.copies {
+		if computing(c) {
+			return false
+		}
+	}
+	root.Attempt++
+	if root.Attempt >= s.job.settings.MaxAttempts {
+		s.bury(root)
+		printErr("FATAL: WorkUnit " + strconv.Itoa(root.ID) + " of job " + s.job.Name + " got no quorum in " + strconv.Itoa(s.job.settings.MaxAttempts) + " attempt(s)")
+		return false
+	}
+	printWarn("Results of WU " + strconv.Itoa(root.ID) + " of job " + s.job.Name + " disagree, sending another replica")
+	s.replicate(root, 1)
+	return false
+}
+
+// cancelCopies stops the copies of the WU except the given one, they are not needed anymore
+func (s *Scheduler) cancelCopies(root, except *WorkUnit) {
+	for _, c := range root.copies {
+		if c != except && computing(c) {
+			c.Status = "cancelled"
+			s.stop(c)
+			s.remove(c)
+		}
+	}
+}
+
+// bury marks the WU as dead, it is never sent again
+func (s *Scheduler) bury(root *WorkUnit) {
+	s.stop(root)
+	s.remove(root)
+	root.Status = "dead"
+	root.votes = nil
+	s.cancelCopies(root, nil)
+	s.dead++
+	s.save(root, false)
+}
+
+// finished checks if the WU is not needed anymore: it is cancelled or its original is completed, dead or invalid
+func finished(wu *WorkUnit) bool {
+	root := wu
+	if wu.Parent != nil {
+		root = wu.Parent
+	}
+	return wu.Status == "cancelled" || root.Status == "completed" || root.Status == "dead" || root.Status == "invalid"
+}
+
+// requeue queues the WU to be sent again. Speculative copies are dropped, their original is queued instead
+func (s *Scheduler) requeue(wu *WorkUnit) {
+	if finished(wu) {
+		return
+	}
+	if wu.replica {
+		s.push(wu)
+	} else if wu.Parent == nil {
+		s.push(wu)
+		s.save(wu, false)
+	}
+}
+
+// Fail marks the WU as failed ("failed", "timeout" or "oom"), so it is sent again.
+// It returns false if the WU is not needed anymore, its status is kept then
+func (s *Scheduler) Fail(wu *WorkUnit, status string) bool {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.stop(wu)
+	if finished(wu) {
+		return false
+	}
+	wu.Status = status
+	s.requeue(wu)
+	return true
+}
+
+// Reject marks the completed WU as failed when the plugin rejects its result, so it is sent again
+func (s *Scheduler) Reject(wu *WorkUnit) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	wu.Status = "failed"
+	s.requeue(wu)
+}
+
+// Invalidate marks the WU as permanently failed, it is never sent again.
+// It returns false if the WU is not needed anymore, like Fail
+func (s *Scheduler) Invalidate(wu *WorkUnit) bool {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	root := wu
+	if wu.Parent != nil {
+		root = wu.Parent
+	}
+	s.stop(wu)
+	if finished(wu) {
+		return false
+	}
+	wu.Status = "invalid"
+	root.Status = "invalid"
+	root.votes = nil
+	s.stop(root)
+	s.remove(root)
+	s.cancelCopies(root, wu)
+	s.dead++
+	s.save(root, false)
+	return true
+}
+
+// Release marks the client's WUs as stuck, so they are sent to other clients. A lost client may still
+// compute them, so a copy is speculated if the client comes back before they are sent
+func (s *Scheduler) Release(client *Client) int {
+	return s.release(client, false, 0)
+}
+
+// Drop releases the WUs which the client has lost, e.g. it is restarted. They are unassigned,
+// so the originals are sent to other clients instead of speculative copies
+func (s *Scheduler) Drop(client *Client) int {
+	return s.release(client, true, 0)
+}
+
+// DropVersion drops the client's WUs which were sent with the code version, e.g. the client could not build it.
+// The WUs sent with the other versions are still computed
+func (s *Scheduler) DropVersion(client *Client, version int) int {
+	return s.release(client, true, version)
+}
+
+// release requeues the client's WUs which were sent with the code version, or all of them if it is 0
+func (s *Scheduler) release(client *Client, unassign bool, version int) int {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	n := 0
+	for _, wu := range s.byClient[client.ID] {
+		if version != 0 && wu.Version != version {
+			continue
+		}
+		s.stop(wu)
+		wu.Status = "stuck"
+		if unassign {
+			wu.Client = nil
+		}
+		s.requeue(wu)
+		n++
+	}
+	return n
+}
+
+// Expire marks the WUs which exceeded their deadline as stuck
+func (s *Scheduler) Expire(now time.Time) []WorkUnit {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	expired := make([]WorkUnit, 0)
+	for _, wu := range s.running {
+		if wu.Deadline.IsZero() || !now.After(wu.Deadline) {
+			continue
+		}
+		s.stop(wu)
+		wu.Status = "stuck"
+		s.requeue(wu)
+		expired = append(expired, *wu)
+	}
+	return expired
+}
+
+// SetSettings replaces the settings of the job, e.g. when the plugin is reloaded
+func (s *Scheduler) SetSettings(settings Settings) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.job.settings = settings
+}
+
+// Settings returns the current settings of the job
+func (s *Scheduler) Settings() Settings {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return s.job.settings
+}
+
+// SetKeep sets whether the results are kept in memory, it changes when the plugin is reloaded
+func (s *Scheduler) SetKeep(keep bool) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	s.keep = keep
+}
+
+// Get returns the WU by its ID
+func (s *Scheduler) Get(ID int) (*WorkUnit, bool) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	wu, ok := s.units[ID]
+	return wu, ok
+}
+
+// Assigned returns the WU by its ID if it is assigned to the client
+func (s *Scheduler) Assigned(client *Client, ID int) (*WorkUnit, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	wu, ok := s.units[ID]
+	if !ok {
+		return nil, errors.New("Workunit " + strconv.Itoa(ID) + " not found")
+	}
+	if wu.Client != client {
+		return nil, errors.New("Workunit " + strconv.Itoa(ID) + " is not assigned to this client")
+	}
+	return wu, nil
+}
+
+// CountRunning returns the amount of WUs being processed by the client
+func (s *Scheduler) CountRunning(client *Client) int {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return len(s.byClient[client.ID])
+}
+
+// Running returns the copies of the running WUs
+func (s *Scheduler) Running() []WorkUnit {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	res := make([]WorkUnit, 0, len(s.running))
+	for _, wu := range s.running {
+		res = append(res, *wu)
+	}
+	return res
+}
+
+// All returns the copies of the original WUs in the order of registration
+func (s *Scheduler) All() []WorkUnit {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	res := make([]WorkUnit, 0, len(s.order))
+	for _, wu := range s.order {
+		res = append(res, *wu)
+	}
+	return res
+}
+
+// Stats returns the amount of the original WUs by status
+func (s *Scheduler) Stats() map[string]int {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	stats := make(map[string]int)
+	for _, wu := range s.order {
+		stats[wu.Status]++
+	}
+	return stats
+}
+
+// Counts returns the amount of running, waiting and dead WUs
+func (s *Scheduler) Counts() (int, int, int) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return len(s.running), s.queued, s.dead
+}
+
+// Len returns the amount of the original WUs
+func (s *Scheduler) Len() int {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return len(s.order)
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestJob(settings Settings) *Job {
+	job := &Job{Name: "test", settings: settings}
+	job.sched = NewScheduler(job)
+	return job
+}
+
+func newTestClient(ID int) *Client {
+	return &Client{ID: ID, Status: "ready", Threads: 1, Broken: make(map[int]BuildFailure)}
+}
+
+// start adds a new WU and dispatches it to the client, like SendWorkUnit does
+func start(s *Scheduler, client *Client) *WorkUnit {
+	wu := s.Add([]byte("data"), 0, client, 1)
+	s.Dispatch(wu, "running")
+	return wu
+}
+
+func TestSchedulerComplete(t *testing.T) {
+	job := newTestJob(defaultSettings)
+	s := job.sched
+	c1 := newTestClient(1)
+	wu := start(s, c1)
+	if n := s.CountRunning(c1); n != 1 {
+		t.Fatalf("CountRunning = %d, want 1", n)
+	}
+	root, status := s.Complete(wu, []byte("result"))
+	if status != "completed" || root != wu {
+		t.Fatalf("Complete = %v, %q, want the WU and \"completed\"", root, status)
+	}
+	if wu.Status != "completed" || string(wu.Result) != "result" {
+		t.Errorf("WU is %q with %q, want completed with the result", wu.Status, wu.Result)
+	}
+	if n := s.CountRunning(c1); n != 0 {
+		t.Errorf("CountRunning = %d after Complete, want 0", n)
+	}
+	if _, status := s.Complete(wu, []byte("again")); status != "ignored" {
+		t.Errorf("second Complete = %q, want \"ignored\"", status)
+	}
+	if stats := s.Stats(); stats["completed"] != 1 {
+		t.Errorf("Stats = %v, want 1 completed", stats)
+	}
+}
+
+func TestSchedulerKeep(t *testing.T) {
+	job := newTestJob(defaultSettings)
+	s := job.sched
+	s.SetKeep(false)
+	wu := start(s, newTestClient(1))
+	s.Complete(wu, []byte("result"))
+	if wu.Result != nil {
+		t.Errorf("Result = %q, want nil when the plugin collects the results", wu.Result)
+	}
+}
+
+func TestSchedulerRetry(t *testing.T) {
+	tests := []struct {
+		status      string
+		maxAttempts int // Times the WU is sent again before it is dead
+	}{
+		{"failed", 1},
+		{"failed", 2},
+		{"timeout", 3},
+		{"oom", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.status+"/"+strconv.Itoa(tt.maxAttempts), func(t *testing.T) {
+			settings := defaultSettings
+			settings.MaxAttempts = tt.maxAttempts
+			job := newTestJob(settings)
+			s := job.sched
+			c1, c2 := newTestClient(1), newTestClient(2)
+			wu := start(s, c1)
+			for i := 0; i < tt.maxAttempts; i++ {
+				s.Fail(wu, tt.status)
+				next, ok := s.Next(c2, 1)
+				if !ok || next != wu {
+					t.Fatalf("retry %d: Next = %v, %v, want the failed WU", i+1, next, ok)
+				}
+				if next.Client != c2 || next.Attempt != i+1 {
+					t.Fatalf("retry %d: WU is on client %d with attempt %d", i+1, next.Client.ID, next.Attempt)
+				}
+				s.Dispatch(next, "running")
+			}
+			s.Fail(wu, tt.status)
+			if next, ok := s.Next(c2, 1); ok {
+				t.Fatalf("Next = WU %d, want none after all attempts", next.ID)
+			}
+			if wu.Status != "dead" {
+				t.Errorf("Status = %q, want \"dead\"", wu.Status)
+			}
+			if _, _, dead := s.Counts(); dead != 1 {
+				t.Errorf("dead = %d, want 1", dead)
+			}
+		})
+	}
+}
+
+func TestSchedulerInvalidate(t *testing.T) {
+	job := newTestJob(defaultSettings)
+	s := job.sched
+	wu := start(s, newTestClient(1))
+	s.Invalidate(wu)
+	if wu.Status != "invalid" {
+		t.Errorf("Status = %q, want \"invalid\"", wu.Status)
+	}
+	if _, ok := s.Next(newTestClient(2), 1); ok {
+		t.Error("invalid WU is sent again")
+	}
+	if _, status := s.Complete(wu, []byte("late")); status != "ignored" {
+		t.Errorf("Complete of an invalid WU = %q, want \"ignored\"", status)
+	}
+}
+
+func TestSchedulerReject(t *testing.T) {
+	job := newTestJob(defaultSettings)
+	s := job.sched
+	wu := start(s, newTestClient(1))
+	s.Complete(wu, []byte("result"))
+	s.Reject(wu)
+	next, ok := s.Next(newTestClient(2), 1)
+	if !ok || next != wu || next.Attempt != 1 {
+		t.Fatalf("Next = %v, %v, want the rejected WU sent again", next, ok)
+	}
+}
+
+func TestSchedulerRelease(t *testing.T) {
+	tests := []struct {
+		name      string
+		release   func(s *Scheduler, c *Client) int
+		alive     bool // The client is back before the WU is sent again
+		speculate bool
+	}{
+		{"lost", (*Scheduler).Release, false, false},
+		{"lost and back", (*Scheduler).Release, true, true},
+		{"restarted", (*Scheduler).Drop, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			job := newTestJob(defaultSettings)
+			s := job.sched
+			c1, c2 := newTestClient(1), newTestClient(2)
+			wu := start(s, c1)
+			c1.Status = "lost"
+			if n := tt.release(s, c1); n != 1 {
+				t.Fatalf("released %d WUs, want 1", n)
+			}
+			if wu.Status != "stuck" {
+				t.Fatalf("Status = %q, want \"stuck\"", wu.Status)
+			}
+			if tt.alive {
+				c1.Status = "ready"
+			}
+			next, ok := s.Next(c2, 1)
+			if !ok {
+				t.Fatal("released WU is not sent again")
+			}
+			s.Dispatch(next, "running")
+			if tt.speculate {
+				if next.Parent != wu {
+					t.Fatalf("Next = WU %d, want a copy of WU %d", next.ID, wu.ID)
+				}
+				if s.CountRunning(c1) != 1 {
+					t.Error("original is not computed by the client anymore")
+				}
+				return
+			}
+			if next != wu || wu.Client != c2 {
+				t.Fatalf("Next = WU %d on client %d, want the original on client 2", next.ID, next.Client.ID)
+			}
+			if n := s.CountRunning(c1); n != 0 {
+				t.Errorf("CountRunning of the released client = %d, want 0", n)
+			}
+		})
+	}
+}
+
+func TestSchedulerDropVersion(t *testing.T) {
+	job := newTestJob(defaultSettings)
+	job.CodeVersion = 1
+	s := job.sched
+	c1, c2 := newTestClient(1), newTestClient(2)
+	old := start(s, c1)
+	// The code is reloaded, the client can't build the new version
+	job.CodeVersion = 2
+	broken := start(s, c1)
+	if broken.Version != 2 || old.Version != 1 {
+		t.Fatalf("versions = %d and %d, want 1 and 2", old.Version, broken.Version)
+	}
+	if n := s.DropVersion(c1, 2); n != 1 {
+		t.Fatalf("DropVersion = %d, want 1", n)
+	}
+	if _, err := s.Assigned(c1, old.ID); err != nil {
+		t.Errorf("WU of the previous version is dropped: %v", err)
+	}
+	if _, err := s.Assigned(c1, broken.ID); err == nil {
+		t.Error("WU of the broken version is still assigned")
+	}
+	next, ok := s.Next(c2, 1)
+	if !ok || next != broken {
+		t.Fatalf("Next = %v, %v, want the dropped WU", next, ok)
+	}
+	if v := s.Dispatch(next, "running"); v != 2 {
+		t.Errorf("Dispatch = version %d, want 2", v)
+	}
+}
+
+func TestSchedulerExpire(t *testing.T) {
+	job := newTestJob(defaultSettings)
+	s := job.sched
+	c1, c2 := newTestClient(1), newTestClient(2)
+	wu := s.Add([]byte("data"), time.Minute, c1, 1)
+	s.Dispatch(wu, "running")
+	if expired := s.Expire(time.Now()); len(expired) != 0 {
+		t.Fatalf("Expire = %d WUs before the deadline, want 0", len(expired))
+	}
+	expired := s.Expire(time.Now().Add(time.Hour))
+	if len(expired) != 1 || expired[0].ID != wu.ID {
+		t.Fatalf("Expire = %v, want WU %d", expired, wu.ID)
+	}
+	// The client may still send the result, so a copy is computed meanwhile
+	spec, ok := s.Next(c2, 1)
+	if !ok || spec.Parent != wu {
+		t.Fatalf("Next = %v, %v, want a copy of the stuck WU", spec, ok)
+	}
+	s.Dispatch(spec, "running")
+	root, status := s.Complete(spec, []byte("copy"))
+	if status != "completed" || root != wu || string(wu.Result) != "copy" {
+		t.Fatalf("Complete of the copy = %q, the original is %q with %q", status, wu.Status, wu.Result)
+	}
+	if _, status := s.Complete(wu, []byte("original")); status != "ignored" {
+		t.Errorf("late original = %q, want \"ignored\"", status)
+	}
+	if running, pending, _ := s.Counts(); running != 0 || pending != 0 {
+		t.Errorf("Counts = %d running and %d pending, want none", running, pending)
+	}
+}
+
+func TestSchedulerQuorum(t *testing.T) {
+	tests := []struct {
+		name        string
+		replication int
+		quorum      int
+		maxAttempts int
+		results     []string // By client, in the order they are computed
+		status      string
+		disagreed   []int // Expected flags by client
+		late        bool  // Another client takes a replica first and fails it after the quorum
+	}{
+		{"agree", 2, 0, 2, []string{"a", "a"}, "completed", []int{0, 0}, false},
+		{"majority", 3, 2, 2, []string{"a", "b", "a"}, "completed", []int{0, 1, 0}, false},
+		{"first two agree", 3, 2, 2, []string{"a", "a"}, "completed", []int{0, 0}, false},
+		{"failure after quorum", 3, 2, 2, []string{"a", "a"}, "completed", []int{0, 0}, true},
+		{"extra replica", 2, 0, 2, []string{"a", "b", "b"}, "completed", []int{1, 0, 0}, false},
+		{"no quorum", 2, 0, 1, []string{"a", "b"}, "dead", []int{0, 0}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			settings := defaultSettings
+			settings.Replication, settings.Quorum, settings.MaxAttempts = tt.replication, tt.quorum, tt.maxAttempts
+			job := newTestJob(settings)
+			s := job.sched
+			clients := make([]*Client, len(tt.results))
+			for i := range clients {
+				clients[i] = newTestClient(i + 1)
+			}
+			root := start(s, clients[0])
+			if next, ok := s.Next(clients[0], 2); ok {
+				t.Fatalf("Next = WU %d, a replica is sent to the client which computes the original", next.ID)
+			}
+			var late *WorkUnit
+			if tt.late {
+				late, _ = s.Next(newTestClient(len(clients)+1), 1)
+				s.Dispatch(late, "running")
+			}
+			for i, result := range tt.results {
+				wu := root
+				if i > 0 {
+					var ok bool
+					wu, ok = s.Next(clients[i], 1)
+					if !ok || wu.Parent != root {
+						t.Fatalf("client %d: Next = %v, %v, want a replica", i+1, wu, ok)
+					}
+					s.Dispatch(wu, "running")
+				}
+				_, status := s.Complete(wu, []byte(result))
+				if i < len(tt.results)-1 && status != "voted" {
+					t.Fatalf("client %d: Complete = %q before the quorum, want \"voted\"", i+1, status)
+				}
+			}
+			if root.Status != tt.status {
+				t.Errorf("Status = %q, want %q", root.Status, tt.status)
+			}
+			if root.Status == "completed" && string(root.Result) != tt.results[len(tt.results)-1] {
+				t.Errorf("Result = %q, want the agreed one", root.Result)
+			}
+			for i, cl := range clients {
+				if cl.Disagreed != tt.disagreed[i] {
+					t.Errorf("client %d disagreed %d times, want %d", i+1, cl.Disagreed, tt.disagreed[i])
+				}
+			}
+			if late != nil {
+				if s.Fail(late, "failed") {
+					t.Error("Fail of a cancelled replica = true, want it ignored")
+				}
+				if late.Status != "cancelled" {
+					t.Errorf("cancelled replica is %q after Fail", late.Status)
+				}
+			}
+			if running, _, _ := s.Counts(); running != 0 {
+				t.Errorf("Counts = %d running, want none", running)
+			}
+			// The replicas which are not needed anymore are dropped from the queue
+			if next, ok := s.Next(newTestClient(len(clients)+2), 1); ok {
+				t.Errorf("Next = WU %d, want none", next.ID)
+			}
+		})
+	}
+}
+
+func TestSchedulerBusyReplicas(t *testing.T) {
+	const units = 100
+	settings := defaultSettings
+	settings.Replication = 2
+	job := newTestJob(settings)
+	s := job.sched
+	fast, slow := newTestClient(1), newTestClient(2)
+	roots := make([]*WorkUnit, 0, units)
+	for i := 0; i < units; i++ {
+		if next, ok := s.Next(fast, 1); ok {
+			t.Fatalf("Next = WU %d, a replica is sent to the client which has voted", next.ID)
+		}
+		root := start(s, fast)
+		if _, status := s.Complete(root, []byte("a")); status != "voted" {
+			t.Fatalf("Complete = %q, want \"voted\"", status)
+		}
+		roots = append(roots, root)
+	}
+	// The replicas of the fast client are passed at once, not rescanned
+	if next, ok := s.Next(fast, 1); ok {
+		t.Fatalf("Next = WU %d, a replica is sent to the client which has voted", next.ID)
+	}
+	if c := s.cursor[fast.ID]; c != s.base+len(s.pending) {
+		t.Errorf("cursor of the fast client = %d, want the end of the queue %d", c, s.base+len(s.pending))
+	}
+	for _, root := range roots {
+		rep, ok := s.Next(slow, 1)
+		if !ok || rep.Parent != root {
+			t.Fatalf("Next = %v, %v, want the replica of WU %d", rep, ok, root.ID)
+		}
+		s.Dispatch(rep, "running")
+		if _, status := s.Complete(rep, []byte("a")); status != "completed" {
+			t.Fatalf("Complete = %q, want \"completed\"", status)
+		}
+	}
+	if _, pending, _ := s.Counts(); pending != 0 {
+		t.Errorf("pending = %d, want none", pending)
+	}
+}
+
+func TestSchedulerValidator(t *testing.T) {
+	settings := defaultSettings
+	settings.Replication = 2
+	job := newTestJob(settings)
+	job.validator = prefixValidator{}
+	s := job.sched
+	c1, c2 := newTestClient(1), newTestClient(2)
+	root := start(s, c1)
+	s.Complete(root, []byte("3.14159"))
+	rep, _ := s.Next(c2, 1)
+	s.Dispatch(rep, "running")
+	if _, status := s.Complete(rep, []byte("3.14158")); status != "completed" {
+		t.Errorf("Complete = %q, want the results accepted by Validate", status)
+	}
+}
+
+// prefixValidator accepts the results which differ only in the last byte
+type prefixValidator struct{}
+
+func (prefixValidator) Validate(a, b []byte) bool {
+	return len(a) == len(b) && string(a[:len(a)-1]) == string(b[:len(b)-1])
+}
+
+// TestSchedulerConcurrent runs the clients at once, it is meant for -race
+func TestSchedulerConcurrent(t *testing.T) {
+	const units = 200
+	settings := defaultSettings
+	settings.MaxAttempts = 100
+	settings.Replication = 2
+	job := newTestJob(settings)
+	s := job.sched
+	var wg sync.WaitGroup
+	var addMut sync.Mutex
+	added := 0
+	for c := 1; c <= 4; c++ {
+		wg.Add(1)
+		go func(client *Client) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				wu, ok := s.Next(client, 1)
+				if !ok {
+					addMut.Lock()
+					if added == units {
+						addMut.Unlock()
+						if _, pending, _ := s.Counts(); pending == 0 {
+							return
+						}
+						time.Sleep(time.Millisecond)
+						continue
+					}
+					added++
+					addMut.Unlock()
+					wu = s.Add([]byte("data"), 0, client, 1)
+				}
+				s.Dispatch(wu, "running")
+				s.Running()
+				s.Stats()
+				if i%7 == 0 {
+					s.Fail(wu, "failed")
+					continue
+				}
+				s.Complete(wu, []byte("result"))
+			}
+		}(newTestClient(c))
+	}
+	wg.Wait()
+	if stats := s.Stats(); stats["completed"] != units {
+		t.Errorf("Stats = %v, want %d completed", stats, units)
+	}
+}
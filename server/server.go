@@ -3,6 +3,10 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -28,6 +32,7 @@ import (
 
 	"github.com/fatih/color"
 	"github.com/spf13/viper"
+	"go-panchaea/internal/modpack"
 )
 
 var wg sync.WaitGroup
@@ -36,150 +41,161 @@ var mut sync.Mutex
 
 var ctx context.Context
 
-// Timeout before the workunit is considered to be stuck
-var Timeout *time.Duration
-
 var reg *regexp.Regexp
 
-// WUAttempts declares max failures for one WU, default 2
-var WUAttempts int
-
 // Listener RPC (int?)
 type Listener int
 
 // Clients contains connected clients
-var Clients []Client
-
-// ClientFile stores the code to be sent to the clients
-var ClientFile []byte
-
-// Filename of the code file
-var Filename string
-
-// Status of the server (ready, running, failed)
-var Status string
+var Clients []*Client
 
-var finished chan bool
+// NodeTimeout is the time without heartbeats after which the client is considered to be lost
+var NodeTimeout time.Duration
 
 // Client represents connected client (node)
 type Client struct {
-	ID      int
-	Status  string // "ready", "running", "failed"
-	Threads int
+	ID        int
+	Status    string // "ready", "running", "failed", "lost", "broken"
+	Threads   int
+	Platform  string   // GOOS/GOARCH of the node
+	Node      NodeInfo // Reported by the node on join
+	LastSeen  time.Time
+	Broken    map[int]BuildFailure // Failed builds of the client code by job ID
+	Disagreed int                  // Results which disagreed with the quorum
+
+	credential string // Issued on "hello", the node sends it with every call
+}
+
+// BuildFailure is the client code version the node could not build, with the compiler output
+type BuildFailure struct {
+	Version int
+	Log     string
 }
 
 // NewClient registers a new connected client
-func NewClient(ID int, status string, threads int) {
+func NewClient(ID int, status string, threads int) *Client {
+	cl := &Client{ID: ID, Status: status, Threads: threads, LastSeen: time.Now(), Broken: make(map[int]BuildFailure)}
 	mut.Lock()
-	Clients = append(Clients, Client{ID: ID, Status: status, Threads: threads})
+	Clients = append(Clients, cl)
 	mut.Unlock()
+	return cl
 }
 
-// GetClient returns the client by ID
+// GetClient returns the client by ID and records that it is alive
 func GetClient(ID int) (*Client, bool) {
+	mut.Lock()
+	defer mut.Unlock()
 	for i := range Clients {
 		if Clients[i].ID == ID {
-			return &Clients[i], true
+			Clients[i].LastSeen = time.Now()
+			return Clients[i], true
 		}
 	}
 	return nil, false
 }
 
-// WorkUnit represents registered WU
-type WorkUnit struct {
-	Data    []byte
-	Client  *Client
-	Thread  int // 1 to n
-	Time    time.Time
-	Status  string // "new", "running", "completed", "stuck", "failed", "unknown", "dead"
-	Attempt int
-	Result  []byte
-}
-
-// NewWorkUnit registers a new WU
-func NewWorkUnit(client *Client, data []byte, thread int) *WorkUnit {
-	var wu WorkUnit
-	wu.Client = client
-	wu.Data = data
-	wu.Thread = thread
-	wu.Status = "new"
+// clientAlive checks if the client may still compute its WUs
+func clientAlive(client *Client) bool {
 	mut.Lock()
-	WorkUnits = append(WorkUnits, &wu)
-	mut.Unlock()
-	return &wu
+	defer mut.Unlock()
+	return client.Status != "lost" && client.Status != "failed" && client.Status != "broken"
 }
 
-// GetWorkUnit returns the WU by the client and its thread
-func GetWorkUnit(client *Client, thread int) (*WorkUnit, bool) {
-	wu := &WorkUnit{}
-	ok := false
-	for i := range WorkUnits {
-		select {
-		case <-ctx.Done():
-			return &WorkUnit{}, false
-		default:
-			if WorkUnits[i].Client.ID == client.ID && WorkUnits[i].Thread == thread {
-				wu = WorkUnits[i]
-				ok = true
-			}
+// updateClientStatus sets the client's status according to its WUs
+func updateClientStatus(client *Client) {
+	n := countRunning(client)
+	mut.Lock()
+	if client.Status == "ready" || client.Status == "running" || client.Status == "lost" {
+		if n == 0 {
+			client.Status = "ready"
+		} else {
+			client.Status = "running"
 		}
 	}
-	return wu, ok
+	mut.Unlock()
 }
 
-// GetAvailable returns available WU and assigns it to the client
-func GetAvailable(client *Client, thread int) (*WorkUnit, bool) {
-	for i := range WorkUnits {
-		select {
-		case <-ctx.Done():
-			return &WorkUnit{}, false
-		default:
-			if WorkUnits[i].Status == "stuck" || WorkUnits[i].Status == "failed" {
-				if WorkUnits[i].Attempt >= WUAttempts {
-					mut.Lock()
-					WorkUnits[i].Status = "dead"
-					mut.Unlock()
-					printErr("FATAL: WorkUnit exceeded all " + strconv.Itoa(WUAttempts) + " attempt(s)")
-					continue
-				}
-				mut.Lock()
-				wu := *WorkUnits[i]
-				wu.Client = client
-				wu.Thread = thread
-				wu.Status = "new"
-				wu.Attempt++
-				mut.Unlock()
-				return &wu, true
-			} else if WorkUnits[i].Status == "unknown" {
-				if WorkUnits[i].Attempt >= WUAttempts {
-					mut.Lock()
-					WorkUnits[i].Status = "dead"
-					mut.Unlock()
-					printErr("FATAL: WorkUnit exceeded all " + strconv.Itoa(WUAttempts) + " attempt(s)")
-					continue
-				}
-			}
+// reapClients marks the clients without recent heartbeats as lost
+func reapClients(now time.Time) {
+	lost := make([]*Client, 0)
+	mut.Lock()
+	for i := range Clients {
+		// Broken clients have no WUs to release
+		if Clients[i].Status != "lost" && Clients[i].Status != "broken" && now.Sub(Clients[i].LastSeen) > NodeTimeout {
+			Clients[i].Status = "lost"
+			lost = append(lost, Clients[i])
+		}
+	}
+	mut.Unlock()
+	for _, cl := range lost {
+		n := 0
+		for _, job := range allJobs() {
+			n += job.sched.Release(cl)
 		}
+		printWarn("Client " + strconv.Itoa(cl.ID) + " is lost (last seen " + cl.LastSeen.Format("15:04:05") + "), " + strconv.Itoa(n) + " WU(s) are released")
+	}
+}
+
+// countRunning returns the amount of the client's WUs of all jobs
+func countRunning(client *Client) int {
+	n := 0
+	for _, job := range allJobs() {
+		n += job.sched.CountRunning(client)
 	}
-	return &WorkUnit{}, false
+	return n
 }
 
-// WorkUnits contains all WUs
-var WorkUnits []*WorkUnit
+// WorkUnit represents registered WU
+type WorkUnit struct {
+	ID       int // Unique ID, assigned by the server
+	Data     []byte
+	Client   *Client
+	Thread   int           // 1 to n
+	Time     time.Time     // Time when the WU was sent to the client
+	Deadline time.Time     // The WU is considered to be stuck after it, zero if there is no timeout
+	Timeout  time.Duration // Time the WU may be computed, 0 if there is no limit
+	Status   string        // "new", "queued", "running", "completed", "validating", "stuck", "failed", "timeout", "oom", "unknown", "dead", "invalid", "cancelled"
+	Attempt  int
+	Version  int // Code version of the job the WU is sent with
+	Result   []byte
+	Parent   *WorkUnit   // The original WU if this one is a copy
+	copies   []*WorkUnit // Speculative copies and replicas of the WU
+	replica  bool        // The copy is computed for the quorum, not because the original is stuck
+	votes    []Vote      // Results of the replicas until the quorum is reached
+	pending  bool        // The WU is in the scheduler queue
+	slot     int         // Position of the WU in the scheduler queue
+}
 
 // Reply contains data to be sent to a client
 type Reply struct {
-	Data     string
-	ID       int
-	Bytecode []byte
+	Data       string
+	ID         int
+	Job        int // ID of the WU's job
+	WorkUnit   int
+	Bytecode   []byte
+	IOMode     string        // How the node program receives the WU, only sent by Init
+	Timeout    time.Duration // Time the WU may be computed, the node kills it afterwards
+	Prebuilt   bool          // Bytecode is the node program built for the node's platform, only sent by Init
+	Hash       string        // SHA-256 of Bytecode, only sent by Init
+	Version    int           // Code version of the job, sent by Init, SendWorkUnit and ReloadWorkUnit
+	Credential string        // Issued on "hello", the node sends it with every call
 }
 
 // Receive contains data to be fetched from a client
 type Receive struct {
-	Data     string
-	Status   string
-	ID       int
-	Bytecode []byte
+	Data       string
+	Status     string
+	ID         int
+	Job        int // ID of the WU's job
+	WorkUnit   int
+	Bytecode   []byte
+	Log        string   // stderr of the node program
+	Platform   string   // GOOS/GOARCH of the node, sent with "hello" and Init
+	Token      string   // Join token of the cluster, sent with "hello"
+	NodeKey    string   // Persistent identity of the node, sent with "hello" if the node has a key file
+	Node       NodeInfo // Sent with "hello"
+	Credential string   // Issued by the server on "hello", sent with every call
+	Version    int      // Code version the node could not build, sent with "broken"
 }
 
 // Server represents the reflection of the plugin's Server struct
@@ -190,15 +206,42 @@ type Server interface {
 	Process(res [][]byte) error
 }
 
-var serv Server
+// APIWorkUnit is the running WU, as shown on the dashboard
+type APIWorkUnit struct {
+	ID       int
+	Job      int
+	Client   int
+	Thread   int
+	Status   string
+	Attempt  int
+	Time     time.Time
+	Deadline time.Time
+}
+
+// APIJob is the job, as shown on the dashboard
+type APIJob struct {
+	ID        int
+	Name      string
+	Status    string
+	Priority  int
+	Weight    int
+	Version   int
+	Stats     map[string]int // Amount of WUs by status
+	Progress  float64        // Progress of the job from 0 to 1, -1 if unknown
+	Finishing bool           // The job waits for the running WUs before Process
+}
 
 // APIResponse contains data to be sent to the dashboard
 type APIResponse struct {
 	Warnings  []string
 	Errors    []string
 	Status    string
-	Clients   *[]Client
-	WorkUnits []*WorkUnit
+	Clients   *[]*Client
+	Jobs      []APIJob
+	Policy    Policy
+	WorkUnits []APIWorkUnit
+	Stats     map[string]int // Amount of WUs of all jobs by status
+	Progress  float64        // Mean progress of the jobs which report it, -1 if none of them does
 }
 
 var apiresp APIResponse
@@ -265,184 +308,236 @@ func printWarn(s string) {
         mut.Unlock()
 }
 
-// Init sends the ClientFile to a client
+// hashCode returns the SHA-256 of the client code, so the nodes can verify it and cache the builds
+func hashCode(code []byte) string {
+	sum := sha256.Sum256(code)
+	return hex.EncodeToString(sum[:])
+}
+
+// Init sends the client code of the job to a client
 func (l *Listener) Init(data Receive, reply *Reply) error {
-	if len(ClientFile) == 0 {
+	_, err := authorize(data, reply)
+	if err != nil {
+		return err
+	}
+	job, ok := GetJob(data.Job)
+	if !ok {
+		printErr("[" + strconv.Itoa(data.ID) + "] Job " + strconv.Itoa(data.Job) + " not found!")
+		*reply = Reply{Data: "error", ID: data.ID}
+		return errors.New("Job not found")
+	}
+	mut.Lock()
+	code, filename, version := job.ClientFile, job.Filename, job.CodeVersion
+	mut.Unlock()
+	ioMode := job.sched.Settings().IOMode
+	if len(code) == 0 {
 		printErr("No client file provided")
 		*reply = Reply{Data: "error", ID: data.ID}
 		return errors.New("No input file provided")
 	}
-	*reply = Reply{Data: Filename, ID: data.ID, Bytecode: ClientFile}
+	if CodeMode == "binary" {
+		bin, err := job.buildBinary(data.Platform)
+		if err != nil {
+			printErr("[" + strconv.Itoa(data.ID) + "] " + err.Error())
+			*reply = Reply{Data: "error", ID: data.ID, Job: job.ID}
+			return err
+		}
+		*reply = Reply{Data: filename, ID: data.ID, Job: job.ID, Bytecode: bin, IOMode: ioMode, Prebuilt: true, Hash: hashCode(bin), Version: version}
+		return nil
+	}
+	*reply = Reply{Data: filename, ID: data.ID, Job: job.ID, Bytecode: code, IOMode: ioMode, Hash: hashCode(code), Version: version}
 	return nil
 }
 
-// Finish preapres WUs result and calls the Prepare server function
-func Finish() error {
+// logWorkUnit writes the WU to the log, so it can be re-queued with -resume
+func logWorkUnit(kind string, job *Job, wu WorkUnit, withResult bool) {
+	log.Println("[E] " + kind + " WU, id: " + strconv.Itoa(wu.ID) + ", job: " + job.Name + "; please re-run it manually")
+	log.Println("---------------[start JSON data]---------------")
+	log.Println(string(wu.Data))
+	log.Println("----------------[end JSON data]----------------")
+	if withResult {
+		log.Println("---------------[start JSON result]---------------")
+		log.Println(string(wu.Result))
+		log.Println("----------------[end JSON result]----------------")
+	}
+}
+
+// Finish preapres WUs result of the job and calls the Process server function
+func (job *Job) Finish() error {
 	tick := 0
-	printSuccess("Waiting for the clients to finish WUs...")
+	warned := false
+	started := time.Now()
+	printSuccess("Job " + job.Name + ": waiting for the clients to finish WUs...")
+	job.setFinishing(true)
+	defer job.setFinishing(false)
+wait:
 	for {
 		select {
 		case <-ctx.Done():
-			printErr("Writing WUs data to the log, please do not abort the process")
-			for i := range WorkUnits {
-				log.Println("[E] Not completed WU, id: " + strconv.Itoa(i) + "; please re-run it manually")
-				log.Println("---------------[start JSON data]---------------")
-				log.Println(string(WorkUnits[i].Data))
-				log.Println("----------------[end JSON data]----------------")
-				log.Println("---------------[start JSON result]---------------")
-				log.Println(string(WorkUnits[i].Result))
-				log.Println("----------------[end JSON result]----------------")
-			}
-			return errors.New("Finishing process is terminated by the user!")
+			// handleCleanExit has already dumped the WUs according to DumpOnExit
+			return errors.New("Finishing process of job " + job.Name + " is terminated by the user!")
 		default:
+			if job.isCanceled() {
+				return errors.New("Job " + job.Name + " is canceled")
+			}
 			computing := 0
 			stuck := 0
-			for i := range Clients {
-				if Clients[i].Status == "running" {
+			for _, wu := range job.sched.Running() {
+				if clientAlive(wu.Client) {
 					computing++
-				} else if Clients[i].Status == "stuck" || Clients[i].Status == "unknown" {
+				} else {
 					stuck++
 				}
 			}
-			tick++
-			if computing == 0 {
-				if stuck != 0 {
-					tmp := ""
-					printWarn("There are " + strconv.Itoa(stuck) + " stuck clients, ignore and finish the job? [Y/n]")
-					fmt.Print("    ")
-					fmt.Scanln(&tmp)
-					if tmp == "n" || tmp == "N" {
-						continue
-					} else {
-						break
-					}
+			_, pending, _ := job.sched.Counts()
+			computing += pending
+			replication := job.sched.Settings().Replication
+			if pending > 0 && !warned && replication > 1 {
+				if n := job.countNodes(); n < replication {
+					// The replicas wait for distinct nodes
+					printWarn("Job " + job.Name + " needs " + strconv.Itoa(replication) + " nodes for each WU, only " + strconv.Itoa(n) + " are connected")
+					warned = true
 				}
-				break
 			}
-			if tick%100 == 0 {
-				tmp := ""
-				printWarn("Clients may be stuck, ignore and finish the job? [y/N]")
-				fmt.Print("    ")
-				fmt.Scanln(&tmp)
-				if tmp == "y" || tmp == "Y" {
-					break
-				} else {
-					continue
-				}
+			tick++
+			if computing == 0 && stuck == 0 {
+				break wait
+			}
+			if job.stopWaiting(computing, stuck, tick, time.Since(started)) {
+				break wait
 			}
 			time.Sleep(time.Second)
 		}
 	}
 	var ok, run, stuck, fail int
-	res := make([][]byte, 0)
-	Status = "FINISH"
-	for i := range WorkUnits {
-		res = append(res, WorkUnits[i].Result)
-		switch WorkUnits[i].Status { // "new", "running", "completed", "stuck", "failed", "unknown", "dead"
+	var res [][]byte
+	mut.Lock()
+	job.Status = "FINISH"
+	for _, cl := range Clients {
+		updateBroken(cl)
+	}
+	mut.Unlock()
+	collecting := job.collecting()
+	units := job.sched.All()
+	for i := range units {
+		if !collecting {
+			// Otherwise the results are already collected
+			res = append(res, units[i].Result)
+		}
+		switch units[i].Status { // "new", "running", "completed", "stuck", "failed", "timeout", "oom", "unknown", "dead", "invalid"
 		case "completed":
 			ok++
-		case "new":
-			log.Println("[E] Not completed WU, id: " + strconv.Itoa(i) + "; please re-run it manually")
-			log.Println("---------------[start JSON data]---------------")
-			log.Println(string(WorkUnits[i].Data))
-			log.Println("----------------[end JSON data]----------------")
-			run++
-		case "running":
-			log.Println("[E] Not completed WU, id: " + strconv.Itoa(i) + "; please re-run it manually")
-			log.Println("---------------[start JSON data]---------------")
-			log.Println(string(WorkUnits[i].Data))
-			log.Println("----------------[end JSON data]----------------")
+		case "new", "running", "validating":
+			logWorkUnit("Not completed", job, units[i], false)
 			run++
 		case "stuck":
-			log.Println("[E] Stuck WU, id: " + strconv.Itoa(i) + "; please re-run it manually")
-			log.Println("---------------[start JSON data]---------------")
-			log.Println(string(WorkUnits[i].Data))
-			log.Println("----------------[end JSON data]----------------")
+			logWorkUnit("Stuck", job, units[i], false)
 			stuck++
-		case "failed":
-			log.Println("[E] Failed WU, id: " + strconv.Itoa(i) + "; please re-run it manually")
-			log.Println("---------------[start JSON data]---------------")
-			log.Println(string(WorkUnits[i].Data))
-			log.Println("----------------[end JSON data]----------------")
-			fail++
-		case "unknown":
-			log.Println("[E] Failed WU, id: " + strconv.Itoa(i) + "; please re-run it manually")
-			log.Println("---------------[start JSON data]---------------")
-			log.Println(string(WorkUnits[i].Data))
-			log.Println("----------------[end JSON data]----------------")
-			fail++
-		case "dead":
-			log.Println("[E] Failed WU, id: " + strconv.Itoa(i) + "; please re-run it manually")
-			log.Println("---------------[start JSON data]---------------")
-			log.Println(string(WorkUnits[i].Data))
-			log.Println("----------------[end JSON data]----------------")
+		case "failed", "timeout", "oom", "unknown", "dead", "invalid":
+			logWorkUnit("Failed", job, units[i], false)
 			fail++
 		}
 	}
-	printWarn("WARN: " + strconv.Itoa(ok) + " WUs completed, " + strconv.Itoa(run) + " in process, " + strconv.Itoa(stuck) + " stuck and " + strconv.Itoa(fail) + " failed.")
+	printWarn("Job " + job.Name + ": " + strconv.Itoa(ok) + " WUs completed, " + strconv.Itoa(run) + " in process, " + strconv.Itoa(stuck) + " stuck and " + strconv.Itoa(fail) + " failed.")
 	printWarn("Failed WUs info will appear in the log file")
-	err := serv.Process(res)
+	job.servMut.RLock()
+	err := job.serv.Process(res)
+	job.servMut.RUnlock()
 	if err != nil {
 		printErr(err.Error())
 		return err
 	}
+	err = job.journal.Archive()
+	if err != nil {
+		printErr("Could not archive the journal: " + err.Error())
+	}
 	return nil
 }
 
+// clientJob returns the client and the job of the WU, the reply is set if any of them is not found
+func clientJob(data Receive, reply *Reply) (*Client, *Job, error) {
+	ID := data.ID
+	cli, err := authorize(data, reply)
+	if err != nil {
+		return nil, nil, err
+	}
+	job, ok := GetJob(data.Job)
+	if !ok {
+		printErr("[" + strconv.Itoa(ID) + "] Job " + strconv.Itoa(data.Job) + " not found!")
+		*reply = Reply{Data: "job not found", ID: ID, Job: data.Job, WorkUnit: data.WorkUnit}
+		return nil, nil, errors.New("Job not found")
+	}
+	if job.isCanceled() {
+		*reply = Reply{Data: "job is canceled", ID: ID, Job: job.ID, WorkUnit: data.WorkUnit}
+		return nil, nil, errors.New("Job " + job.Name + " is canceled")
+	}
+	return cli, job, nil
+}
+
 // FetchWorkUnit gets the completed WU from a client
 func (l *Listener) FetchWorkUnit(data Receive, reply *Reply) error {
 	ID := data.ID
-	cli, ok := GetClient(ID)
-	if !ok {
-		printErr("[" + strconv.Itoa(ID) + "] " + "Client not found!")
-		*reply = Reply{Data: "client not found", ID: ID}
-		return errors.New("Client not found")
+	cli, job, err := clientJob(data, reply)
+	if err != nil {
+		return err
+	}
+	if data.Log != "" {
+		log.Println("[W]:    [" + strconv.Itoa(ID) + "] stderr of WU " + strconv.Itoa(data.WorkUnit) + " of job " + job.Name + ":\n" + data.Log)
 	}
 	if data.Status != "upload" {
-		thread, err := strconv.Atoi(strings.Split(data.Status, " ")[1])
+		printErr("[" + strconv.Itoa(ID) + "] " + data.Data)
+		wu, err := job.sched.Assigned(cli, data.WorkUnit)
 		if err != nil {
-			printErr(err.Error())
+			printErr("[" + strconv.Itoa(ID) + "] " + err.Error())
+			*reply = Reply{Data: "error", ID: ID, Job: job.ID, WorkUnit: data.WorkUnit}
 			return err
 		}
-		printErr("[" + strconv.Itoa(ID) + "] " + data.Data)
-		wu, ok := GetWorkUnit(cli, thread)
-		if !ok {
-			printErr("[" + strconv.Itoa(ID) + "] " + "Error not found! Cannot compute")
-			*reply = Reply{Data: "error", ID: ID}
-			return errors.New("Cannot compute")
+		var needed bool
+		if strings.HasPrefix(data.Status, "invalid") {
+			// The node program declared that the WU can never be computed
+			needed = job.sched.Invalidate(wu)
+		} else if strings.HasPrefix(data.Status, "timeout") {
+			needed = job.sched.Fail(wu, "timeout")
+		} else if strings.HasPrefix(data.Status, "oom") {
+			needed = job.sched.Fail(wu, "oom")
+		} else {
+			needed = job.sched.Fail(wu, "failed")
 		}
-		wu.Status = "failed"
-		*reply = Reply{Data: "error", ID: ID}
-		return errors.New(data.Data)
+		updateClientStatus(cli)
+		err = errors.New(data.Data)
+		if needed {
+			job.workUnitFailed(wu.Data, err)
+		} else {
+			log.Println("[I]:    [" + strconv.Itoa(ID) + "] WU " + strconv.Itoa(wu.ID) + " of job " + job.Name + " is already finished, the failure is ignored")
+		}
+		*reply = Reply{Data: "error", ID: ID, Job: job.ID, WorkUnit: wu.ID}
+		return err
 	}
-	thread, err := strconv.Atoi(data.Data)
+	wu, err := job.sched.Assigned(cli, data.WorkUnit)
 	if err != nil {
-		printErr(err.Error())
-		*reply = Reply{Data: "error", ID: ID}
+		printErr("[" + strconv.Itoa(ID) + "] " + err.Error())
+		*reply = Reply{Data: "error", ID: ID, Job: job.ID, WorkUnit: data.WorkUnit}
 		return err
 	}
-	wu, ok := GetWorkUnit(cli, thread)
-	if !ok {
-		printErr("[" + strconv.Itoa(ID) + "] " + "Workunit not found on thread " + strconv.Itoa(thread))
-		*reply = Reply{Data: "error", ID: ID}
-		return errors.New("Workunit not found")
+	root, status := job.sched.Complete(wu, data.Bytecode)
+	if status == "ignored" {
+		log.Println("[I]:    [" + strconv.Itoa(ID) + "] WU " + strconv.Itoa(wu.ID) + " of job " + job.Name + " is already finished, the result is ignored")
+	} else if status == "voted" {
+		log.Println("[I]:    [" + strconv.Itoa(ID) + "] WU " + strconv.Itoa(root.ID) + " of job " + job.Name + " waits for the quorum")
+	} else if job.collecting() {
+		job.collect(root, data.Bytecode)
 	}
-	mut.Lock()
-	wu.Status = "completed"
-	wu.Result = data.Bytecode
-	mut.Unlock()
-	*reply = Reply{Data: "ok", ID: ID}
+	updateClientStatus(cli)
+	*reply = Reply{Data: "ok", ID: ID, Job: job.ID, WorkUnit: wu.ID}
 	return nil
 }
 
-// SendWorkUnit sends the WU to a client
+// SendWorkUnit sends a WU of one of the jobs to a client
 func (l *Listener) SendWorkUnit(data Receive, reply *Reply) error {
 	ID := data.ID
-	cli, ok := GetClient(ID)
-	if !ok {
-		printErr("[" + strconv.Itoa(ID) + "] " + "Client not found!")
-		*reply = Reply{Data: "client not found", ID: ID}
-		return errors.New("Client not found")
+	cli, err := authorize(data, reply)
+	if err != nil {
+		return err
 	}
 	thread, err := strconv.Atoi(data.Data)
 	if err != nil {
@@ -450,60 +545,87 @@ func (l *Listener) SendWorkUnit(data Receive, reply *Reply) error {
 		*reply = Reply{Data: "error", ID: ID}
 		return err
 	}
-	wu, ok := GetAvailable(cli, thread)
-	if !ok {
-		work, err := serv.Run(ID)
-		if err != nil {
-			printErr(err.Error()) // No more WUs, finishing...
-			finished <- true
-			*reply = Reply{Data: "error", ID: ID}
-			return err
-		}
-		wu = NewWorkUnit(cli, work, thread)
+	mut.Lock()
+	broken := cli.Status == "broken"
+	mut.Unlock()
+	if broken {
+		*reply = Reply{Data: "broken", ID: ID}
+		return errors.New("The client could not build the client code")
 	}
 	if data.Status == "error" {
 		*reply = Reply{Data: "error", ID: ID}
 		printErr(data.Data)
 		return errors.New(data.Data)
 	}
-	mut.Lock()
-	wu.Status = "running"
-	mut.Unlock()
-	*reply = Reply{Data: "ok", ID: ID, Bytecode: wu.Data}
-	return nil
+	err = errors.New("No WUs to send")
+	for _, job := range jobsFor(cli) {
+		wu, ok := job.sched.Next(cli, thread)
+		if !ok {
+			if job.isExhausted() {
+				continue
+			}
+			var work []byte
+			work, err = job.nextWork(ID)
+			if err != nil {
+				job.exhaust(err)
+				continue
+			}
+			wu = job.sched.Add(work, job.wuTimeout(work), cli, thread)
+		}
+		version := job.sched.Dispatch(wu, "running")
+		updateClientStatus(cli)
+		*reply = Reply{Data: "ok", ID: ID, Job: job.ID, WorkUnit: wu.ID, Bytecode: wu.Data, Timeout: wu.Timeout, Version: version}
+		return nil
+	}
+	*reply = Reply{Data: "error", ID: ID}
+	return err
+}
+
+// nextWork gets a new WU from the plugin, skipping the ones restored from the journal
+func (job *Job) nextWork(ID int) ([]byte, error) {
+	for {
+		job.servMut.RLock()
+		work, err := job.serv.Run(ID)
+		job.servMut.RUnlock()
+		if err != nil {
+			return nil, err
+		}
+		mut.Lock()
+		n, ok := job.Replayed[string(work)]
+		if ok {
+			if n <= 1 {
+				delete(job.Replayed, string(work))
+			} else {
+				job.Replayed[string(work)]--
+			}
+		}
+		mut.Unlock()
+		if !ok {
+			return work, nil
+		}
+	}
 }
 
 // ReloadWorkUnit sends the WU again if necessary
 func (l *Listener) ReloadWorkUnit(data Receive, reply *Reply) error {
 	ID := data.ID
-	cli, ok := GetClient(ID)
-	if !ok {
-		printErr("[" + strconv.Itoa(ID) + "] " + "Client not found!")
-		*reply = Reply{Data: "client not found", ID: ID}
-		return errors.New("Client not found")
-	}
-	thread, err := strconv.Atoi(data.Data)
+	cli, job, err := clientJob(data, reply)
 	if err != nil {
-		printErr(err.Error())
-		*reply = Reply{Data: "error", ID: ID}
 		return err
 	}
-	wu, ok := GetWorkUnit(cli, thread)
-	if !ok {
-		printErr("[" + strconv.Itoa(ID) + "] " + "Cannot re-upload: no such WU!")
-		*reply = Reply{Data: "no such wu", ID: ID}
+	wu, err := job.sched.Assigned(cli, data.WorkUnit)
+	if err != nil {
+		printErr("[" + strconv.Itoa(ID) + "] " + "Cannot re-upload: " + err.Error())
+		*reply = Reply{Data: "no such wu", ID: ID, Job: job.ID, WorkUnit: data.WorkUnit}
 		return errors.New("Cannot re-upload: no such WU")
 	}
-	if wu.Attempt >= WUAttempts || wu.Status == "dead" {
-		printErr("[" + strconv.Itoa(ID) + "] " + "Cannot re-upload: too many failed attempts!")
-		*reply = Reply{Data: "dead", ID: ID}
-		return errors.New("Cannot re-upload: too many failed attempts")
+	version, err := job.sched.Reload(wu)
+	if err != nil {
+		printErr("[" + strconv.Itoa(ID) + "] " + err.Error())
+		*reply = Reply{Data: "dead", ID: ID, Job: job.ID, WorkUnit: wu.ID}
+		return err
 	}
-	mut.Lock()
-	wu.Attempt++
-	wu.Status = "unknown"
-	mut.Unlock()
-	*reply = Reply{Data: "ok", ID: ID, Bytecode: wu.Data}
+	*reply = Reply{Data: "ok", ID: ID, Job: job.ID, WorkUnit: wu.ID, Bytecode: wu.Data, Timeout: wu.Timeout, Version: version}
 	return nil
 }
 
@@ -511,64 +633,193 @@ func (l *Listener) ReloadWorkUnit(data Receive, reply *Reply) error {
 func (l *Listener) SendStatus(data Receive, reply *Reply) error {
 	if data.Status == "hello" {
 		ID := data.ID
-		if ID == -1 {
-			ID = len(Clients) + 1
+		if !validJoinToken(data.Token) {
+			printErr("[" + strconv.Itoa(ID) + "] " + "Client is rejected: invalid join token")
+			*reply = Reply{Data: "unauthorized", ID: ID}
+			return ErrUnauthorized
 		}
-		printSuccess("Client " + strconv.Itoa(ID) + " is connected")
 		threads, err := strconv.Atoi(data.Data)
 		if err != nil {
 			printErr(err.Error())
 			threads = 1
 		}
-		NewClient(ID, "ready", threads)
-		*reply = Reply{Data: "ok", ID: ID}
-	} else if data.Status == "ready" {
-		printSuccess("Client " + strconv.Itoa(data.ID) + " is ready")
-		cl, ok := GetClient(data.ID)
+		cl, ok := GetClient(ID)
 		if ok {
+			mut.Lock()
+			// Only the node which joined with this ID may take it back
+			ok = cl.credential != "" && subtle.ConstantTimeCompare([]byte(cl.credential), []byte(data.Credential)) == 1
+			mut.Unlock()
+			if !ok && ID != -1 {
+				printWarn("[" + strconv.Itoa(ID) + "] " + "Client presented a wrong credential, it gets a new ID")
+			}
+		}
+		if data.Node.Version != Version {
+			printWarn("Client runs Panchaea " + data.Node.Version + ", the server runs " + Version)
+		}
+		credential := data.Credential
+		if ok {
+			// The node has lost the connection, its WUs are still assigned to it
 			mut.Lock()
 			cl.Status = "ready"
+			cl.Threads = threads
+			cl.Platform = data.Platform
+			cl.Node = data.Node
+			updateBroken(cl)
 			mut.Unlock()
-			*reply = Reply{Data: "ok", ID: data.ID}
+			updateClientStatus(cl)
+			printSuccess("Client " + strconv.Itoa(ID) + " is reconnected, " + strconv.Itoa(countRunning(cl)) + " WU(s) in process")
 		} else {
-			printErr("[" + strconv.Itoa(data.ID) + "] " + "Client not found!")
-			*reply = Reply{Data: "client not found", ID: data.ID}
+			// The client's own ID is never trusted, the registry issues it
+			var known bool
+			ID, known, err = issueID(data.NodeKey, data.Node)
+			if err != nil {
+				printWarn("Could not save the node registry: " + err.Error())
+			}
+			credential, err = newCredential()
+			if err != nil {
+				printErr(err.Error())
+				*reply = Reply{Data: "error", ID: ID}
+				return err
+			}
+			cl, ok = GetClient(ID)
+			restarted := known && ok
+			if restarted {
+				// The node is restarted, it has lost the WUs of its previous run
+				n := 0
+				for _, job := range allJobs() {
+					n += job.sched.Drop(cl)
+				}
+				mut.Lock()
+				cl.Status = "ready"
+				cl.Threads = threads
+				cl.Broken = make(map[int]BuildFailure)
+				updateBroken(cl)
+				mut.Unlock()
+				printSuccess("Client " + strconv.Itoa(ID) + " (" + data.Node.Hostname + ") is restarted, " + strconv.Itoa(n) + " WU(s) are released")
+			} else {
+				cl = NewClient(ID, "ready", threads)
+				printSuccess("Client " + strconv.Itoa(ID) + " (" + data.Node.Hostname + ") is connected")
+			}
+			mut.Lock()
+			cl.Platform = data.Platform
+			cl.Node = data.Node
+			cl.credential = credential
+			mut.Unlock()
+			if !restarted {
+				clientJoined(ID)
+			}
+		}
+		*reply = Reply{Data: "ok", ID: ID, Credential: credential}
+	} else if data.Status == "ready" {
+		cl, err := authorize(data, reply)
+		if err != nil {
+			return err
+		}
+		printSuccess("Client " + strconv.Itoa(data.ID) + " is ready")
+		mut.Lock()
+		cl.Status = "ready"
+		updateBroken(cl)
+		mut.Unlock()
+		*reply = Reply{Data: "ok", ID: data.ID}
+	} else if data.Status == "broken" {
+		cl, job, err := clientJob(data, reply)
+		if err != nil {
+			return err
+		}
+		mut.Lock()
+		version := data.Version
+		if version == 0 {
+			// Older nodes don't report the version, it is the current one
+			version = job.CodeVersion
 		}
+		cl.Broken[job.ID] = BuildFailure{Version: version, Log: data.Data}
+		updateBroken(cl)
+		mut.Unlock()
+		printErr("[" + strconv.Itoa(data.ID) + "] Could not build the client code version " + strconv.Itoa(version) + " of job " + job.Name + ":\n" + data.Data)
+		// The node gets no WUs of this job until its code is reloaded. The WUs sent with the previous versions are still computed
+		n := job.sched.DropVersion(cl, version)
+		if n != 0 {
+			printWarn(strconv.Itoa(n) + " WU(s) of job " + job.Name + " on client " + strconv.Itoa(data.ID) + " are released")
+		}
+		updateClientStatus(cl)
+		*reply = Reply{Data: "ok", ID: data.ID, Job: job.ID}
 	} else if data.Status == "error" {
-		cl, ok := GetClient(data.ID)
-		if ok {
-			cl.Status = "failed"
+		cl, err := authorize(data, reply)
+		if err != nil {
+			return err
 		}
+		mut.Lock()
+		cl.Status = "failed"
+		mut.Unlock()
 		printErr("[" + strconv.Itoa(data.ID) + "] " + data.Data)
 	}
 	return nil
 }
 
+// Heartbeat tells the server that the client is alive
+func (l *Listener) Heartbeat(data Receive, reply *Reply) error {
+	cl, err := authorize(data, reply)
+	if err != nil {
+		return err
+	}
+	mut.Lock()
+	lost := cl.Status == "lost"
+	mut.Unlock()
+	if lost {
+		printWarn("Client " + strconv.Itoa(data.ID) + " is back")
+		updateClientStatus(cl)
+	}
+	*reply = Reply{Data: "ok", ID: data.ID}
+	return nil
+}
+
 func initProject(client_file string) (error, string) {
 	if *overwrite {
-		Filename = ""
-		printWarn("Please provide the client file")
+		filename := ""
+		printWarn("Please provide the client file or the module directory")
 		fmt.Print("    ")
-		fmt.Scanln(&Filename)
-		client_file = Filename
+		fmt.Scanln(&filename)
+		client_file = filename
 	}
-	f, err := os.Open(client_file)
+	_, err := os.Stat(client_file)
 	if err != nil {
 		return err, ""
 	}
+	return nil, client_file
+}
+
+// readClientCode reads the client file or packs the module directory, it returns the code and its file name
+func readClientCode(client_file string) ([]byte, string, error) {
+	info, err := os.Stat(client_file)
+	if err != nil {
+		return nil, "", err
+	}
+	if info.IsDir() {
+		code, err := packModule(client_file)
+		if err != nil {
+			return nil, "", err
+		}
+		abs, err := filepath.Abs(client_file)
+		if err != nil {
+			return nil, "", err
+		}
+		return code, filepath.Base(abs) + modpack.Suffix, nil
+	}
+	f, err := os.Open(client_file)
+	if err != nil {
+		return nil, "", err
+	}
 	defer f.Close()
-	ClientFile, err = ioutil.ReadAll(f)
+	code, err := ioutil.ReadAll(f)
 	if err != nil {
-		return err, ""
+		return nil, "", err
 	}
 	_, file := filepath.Split(client_file)
-	Filename = file
-	printSuccess("File is succesfully loaded")
-	WUAttempts = 2
-	return nil, client_file
+	return code, file, nil
 }
 
-func initCliConn(port string) (*net.TCPListener, string, error) {
+// initCliConn listens for the nodes on the bind address, the connections are encrypted if tlsConfig is set
+func initCliConn(bind, port string, tlsConfig *tls.Config) (net.Listener, string, error) {
 	printSuccess("Resolving TCP Address...")
 	if *overwrite {
 		printWarn("Please type in the communication port")
@@ -576,28 +827,38 @@ func initCliConn(port string) (*net.TCPListener, string, error) {
 		port = ""
 		fmt.Scanln(&port)
 	}
-	address, err := net.ResolveTCPAddr("tcp", "127.0.0.1:"+port)
+	address, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(bind, port))
 	if err != nil {
 		return nil, "", err
 	}
-	in, err := net.ListenTCP("tcp", address)
+	tcp, err := net.ListenTCP("tcp", address)
 	if err != nil {
 		return nil, "", err
 	}
+	var in net.Listener = tcp
+	if tlsConfig != nil {
+		in = tls.NewListener(tcp, tlsConfig)
+		if tlsConfig.ClientAuth == tls.RequireAndVerifyClientCert {
+			printSuccess("Listening on " + net.JoinHostPort(bind, port) + " (TLS, node certificates are required)")
+		} else {
+			printSuccess("Listening on " + net.JoinHostPort(bind, port) + " (TLS)")
+		}
+	} else {
+		printSuccess("Listening on " + net.JoinHostPort(bind, port))
+	}
 	listener := new(Listener)
 	rpc.Register(listener)
 	return in, port, nil
 }
 
-func processRPC(in *net.TCPListener) {
+func processRPC(in net.Listener) {
 	defer wg.Done()
 	printSuccess("Running..")
 	rpc.Accept(in)
 }
 
-func buildServer(filename string) (string, error) {
+func buildServer(filename, output string) (string, error) {
 	flag := "-o"
-	output := "build.so"
 	goexec, err := exec.LookPath("go")
 	debugParam := ""
 	if err != nil {
@@ -620,17 +881,14 @@ func buildServer(filename string) (string, error) {
 	if out.String() != "" {
 		fmt.Println(out.String())
 	}
-	if stderr.String() != "" {
-		color.Red(stderr.String())
-	}
 	if err != nil {
-		return file_out, err
+		return file_out, errors.New("Could not build the plugin: " + strings.TrimSpace(stderr.String()))
 	}
 	printSuccess("Build is complete!")
 	return file_out, nil
 }
 
-func initClientServer(server_file string) (func() interface{}, string, error) {
+func initClientServer(server_file string) (string, error) {
 	if *overwrite {
 		filename := ""
 		printWarn("Please provide the server file")
@@ -638,36 +896,45 @@ func initClientServer(server_file string) (func() interface{}, string, error) {
 		fmt.Scanln(&filename)
 		server_file = filename
 	}
-	out, err := buildServer(server_file)
+	_, err := os.Stat(server_file)
 	if err != nil {
-		return nil, "", err
+		return "", err
 	}
+	return server_file, nil
+}
+
+// openPlugin loads the built plugin and finds its GetServer function and settings
+func openPlugin(out string) (func() interface{}, pluginVars, error) {
 	plug, err := plugin.Open(out)
 	if err != nil {
-		return nil, "", err
+		return nil, pluginVars{}, err
 	}
 	run, err := plug.Lookup("GetServer")
 	if err != nil {
-		return nil, "", err
+		return nil, pluginVars{}, err
+	}
+	GetServer, ok := run.(func() interface{})
+	if !ok {
+		return nil, pluginVars{}, errors.New("GetServer must be func() interface{}")
 	}
-	GetServer := run.(func() interface{})
-	dur, err := plug.Lookup("Timeout")
+	vars, err := lookupSettings(func(name string) (interface{}, error) {
+		return plug.Lookup(name)
+	})
 	if err != nil {
-		return nil, "", err
+		return nil, pluginVars{}, err
 	}
-	tim := dur.(*time.Duration)
-	Timeout = tim
-	return GetServer, server_file, nil
+	return GetServer, vars, nil
 }
 
-func initPluginStruct(GetServer func() interface{}) error {
+func (job *Job) initPluginStruct(GetServer func() interface{}) error {
 	servInter := GetServer()
 	s, ok := servInter.(Server)
 	if !ok {
 		return errors.New("Could not receive the server interface!")
 	}
 	s.Init()
-	serv = s
+	job.serv = s
+	job.initHooks(servInter)
 	return nil
 }
 
@@ -683,7 +950,7 @@ func initLogger() (*os.File, error) {
 }
 
 func initContext(kill chan bool) {
-	cont, cls := context.WithTimeout(context.Background(), time.Second)
+	cont, cls := context.WithCancel(context.Background())
 	ctx = cont
 	go func() {
 		<-kill
@@ -691,7 +958,7 @@ func initContext(kill chan bool) {
 	}()
 }
 
-func handleInterrupt(kill chan bool, lis *net.TCPListener) {
+func handleInterrupt(kill chan bool, lis net.Listener) {
 	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
 	<-ch
@@ -703,62 +970,74 @@ func handleInterrupt(kill chan bool, lis *net.TCPListener) {
 
 func handleCleanExit(kill chan bool, f *os.File, webserver *http.Server) {
 	<-kill
-	tmp := ""
-	printWarn("[!] Dump WUs data to the log (" + strconv.Itoa(len(WorkUnits)*7) + " lines)? [Y/n]")
-	fmt.Print("    ")
-	fmt.Scanln(&tmp)
-	if tmp == "n" || tmp == "N" {
+	jobs := allJobs()
+	lines := 0
+	for _, job := range jobs {
+		lines += job.sched.Len() * 7
+	}
+	if !dumpOnExit(lines) {
 		printSuccess("Exiting...")
 	} else {
 		printErr("Writing WUs data to the log, please do not abort the process")
-		for i := range WorkUnits {
-			log.Println("[E] Not completed WU, id: " + strconv.Itoa(i) + "; please re-run it manually")
-			log.Println("---------------[start JSON data]---------------")
-			log.Println(string(WorkUnits[i].Data))
-			log.Println("----------------[end JSON data]----------------")
-			log.Println("---------------[start JSON result]---------------")
-			log.Println(string(WorkUnits[i].Result))
-			log.Println("----------------[end JSON result]----------------")
+		for _, job := range jobs {
+			units := job.sched.All()
+			for i := range units {
+				logWorkUnit("Not completed", job, units[i], true)
+			}
 		}
 	}
+	for _, job := range jobs {
+		err := job.journal.Close()
+		if err != nil {
+			printErr(err.Error())
+		}
+		if job.journal != nil {
+			printSuccess("WUs of job " + job.Name + " are saved in the journal (" + job.journal.filename + "), restart the server to resume the job")
+		}
+		close(job.finished)
+	}
 	f.Close()
-	close(finished)
 	err := webserver.Shutdown(ctx)
 	if err != nil {
 		printErr(err.Error())
 	}
 }
-func handleFinish() {
+
+func (job *Job) handleFinish() {
 	defer wg.Done()
-	<-finished
-	err := Finish()
+	<-job.finished
+	if job.isCanceled() {
+		job.shutdown()
+		return
+	}
+	err := job.Finish()
 	if err != nil {
 		printErr(err.Error())
 	}
+	job.shutdown()
 }
 
 func handleClients(tick *time.Ticker) {
 	defer wg.Done()
-	for next := range tick.C {
+	for {
 		select {
 		case <-ctx.Done():
 			tick.Stop()
 			return
-		default:
-			ok := false
-			for i := range WorkUnits {
-				if WorkUnits[i].Status == "running" || WorkUnits[i].Status == "stuck" {
-					WorkUnits[i].Time.Add(time.Second)
-					Status = "RUNNING"
-					ok = true
-				}
-				if WorkUnits[i].Time.After(next.Add(*Timeout)) {
-					WorkUnits[i].Status = "stuck"
-				}
-				if !ok {
-					Status = "FAILED"
-				}
-			}
+		case now := <-tick.C:
+			reapClients(now)
+			expireWorkUnits(now)
+		}
+	}
+}
+
+// expireWorkUnits marks the WUs which exceeded their deadline as stuck, so they are sent to another client
+func expireWorkUnits(now time.Time) {
+	for _, job := range allJobs() {
+		expired := job.sched.Expire(now)
+		job.updateStatus()
+		for _, wu := range expired {
+			printWarn("WU " + strconv.Itoa(wu.ID) + " of job " + job.Name + " on client " + strconv.Itoa(wu.Client.ID) + " exceeded its deadline (sent at " + wu.Time.Format("15:04:05") + ")")
 		}
 	}
 }
@@ -779,6 +1058,20 @@ func initConfig() (string, string, string, string, *viper.Viper) {
 	v.SetDefault("Port", "0")
 	v.SetDefault("ServerFile", "")
 	v.SetDefault("DashboardPort", "0")
+	v.SetDefault("JournalFile", "panchaea_journal.jsonl")
+	v.SetDefault("NodeTimeout", "30s")
+	v.SetDefault("CodeMode", "source")
+	v.SetDefault("BindAddr", "127.0.0.1")
+	v.SetDefault("TLSCert", "")
+	v.SetDefault("TLSKey", "")
+	v.SetDefault("TLSClientCA", "")
+	v.SetDefault("JoinTokens", []string{})
+	v.SetDefault("DashboardAddr", "127.0.0.1")
+	v.SetDefault("APIToken", "")
+	v.SetDefault("NodesFile", "panchaea_nodes.json")
+	v.SetDefault("Headless", false)
+	v.SetDefault("FinishPolicy", "")
+	v.SetDefault("DumpOnExit", "")
 	v.SetConfigName(filename[0])
 	v.SetConfigType(filename[1])
 	v.AddConfigPath(dir)
@@ -813,11 +1106,45 @@ func writeConfig(v *viper.Viper, client_file, port, server_file, dashboard_port
 	return nil
 }
 
+// info returns the job as shown on the dashboard
+func (job *Job) info(stats map[string]int, progress float64) APIJob {
+	mut.Lock()
+	defer mut.Unlock()
+	return APIJob{ID: job.ID, Name: job.Name, Status: job.Status, Priority: job.Priority, Weight: job.Weight, Version: job.CodeVersion, Stats: stats, Progress: progress, Finishing: job.finishing}
+}
+
 func initAPI() {
-	apiresp = APIResponse{Warnings: Warnings, Errors: Errors, Clients: &Clients, WorkUnits: WorkUnits}
+	apiresp = APIResponse{Warnings: Warnings, Errors: Errors, Clients: &Clients, WorkUnits: make([]APIWorkUnit, 0)}
 }
 
 func updateAPI() {
+	units := make([]APIWorkUnit, 0)
+	jobs := make([]APIJob, 0)
+	stats := make(map[string]int)
+	prog, reported := 0.0, 0
+	for _, job := range allJobs() {
+		for _, wu := range job.sched.Running() {
+			units = append(units, APIWorkUnit{ID: wu.ID, Job: job.ID, Client: wu.Client.ID, Thread: wu.Thread, Status: wu.Status, Attempt: wu.Attempt, Time: wu.Time, Deadline: wu.Deadline})
+		}
+		js := job.sched.Stats()
+		for k, n := range js {
+			stats[k] += n
+		}
+		p := job.progress()
+		if p >= 0 {
+			prog += p
+			reported++
+		}
+		jobs = append(jobs, job.info(js, p))
+	}
+	if reported == 0 {
+		prog = -1
+	} else {
+		prog /= float64(reported)
+	}
+	status := serverStatus()
+	mut.Lock()
+	defer mut.Unlock()
 	warn := Warnings
 	err := Errors
 	for i := range warn {
@@ -828,8 +1155,12 @@ func updateAPI() {
 	}
 	apiresp.Warnings = warn
 	apiresp.Errors = err
-	apiresp.WorkUnits = WorkUnits
-	apiresp.Status = Status
+	apiresp.WorkUnits = units
+	apiresp.Jobs = jobs
+	apiresp.Stats = stats
+	apiresp.Progress = prog
+	apiresp.Status = status
+	apiresp.Policy = policy
 	Warnings = []string{}
 	Errors = []string{}
 }
@@ -837,10 +1168,12 @@ func updateAPI() {
 func handleAPI(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	updateAPI()
+	mut.Lock()
 	json.NewEncoder(w).Encode(&apiresp)
+	mut.Unlock()
 }
 
-func initDashboard(port string) (string, *http.Server) {
+func initDashboard(bind, port string) (string, *http.Server) {
 	if *overwrite {
 		port = ""
 		printWarn("Please provide the web dashboard port")
@@ -851,7 +1184,13 @@ func initDashboard(port string) (string, *http.Server) {
 	mux := http.NewServeMux()
 	mux.Handle("/", fs)
 	mux.HandleFunc("/api", handleAPI)
-	webserver := &http.Server{Handler: mux, Addr: ":" + port}
+	mux.HandleFunc("/api/jobs", requireToken(handleJobs))
+	mux.HandleFunc("/api/jobs/", requireToken(handleJobAction))
+	mux.HandleFunc("/api/policy", requireToken(handlePolicy))
+	if APIToken == "" {
+		printWarn("APIToken is not set, the API only shows the jobs")
+	}
+	webserver := &http.Server{Handler: mux, Addr: net.JoinHostPort(bind, port)}
 	return port, webserver
 }
 
@@ -864,9 +1203,14 @@ func handleDashboard(webserver *http.Server) {
 }
 
 var (
-	config_file = flag.String("config", "panchaea_server.json", "config file location")
-	overwrite   = flag.Bool("n", false, "do not read from the config file")
-	debug       = flag.Bool("d", false, "delve debug support for plugins")
+	config_file   = flag.String("config", "panchaea_server.json", "config file location")
+	overwrite     = flag.Bool("n", false, "do not read from the config file")
+	debug         = flag.Bool("d", false, "delve debug support for plugins")
+	resume        = flag.String("resume", "", "re-queue WUs from the log dump or the journal file")
+	api_addr      = flag.String("api", "", "dashboard address of the running server for the job commands, 127.0.0.1:DashboardPort by default")
+	headless      = flag.Bool("headless", false, "never read from the console, e.g. under systemd")
+	finish_policy = flag.String("finish-policy", "", "what to do with the WUs left when a job finishes: ask, wait, ignore-stuck or timeout=<duration>")
+	dump_on_exit  = flag.String("dump-on-exit", "", "write the WUs to the log on exit: ask, always or never")
 )
 
 func main() {
@@ -879,9 +1223,21 @@ func main() {
 	reg = re
 	flag.Parse()
 	client_file, port, server_file, dashboard_port, v := initConfig()
+	if flag.NArg() != 0 {
+		err = runCommand(flag.Args(), v)
+		if err != nil {
+			printErr(err.Error())
+			os.Exit(1)
+		}
+		return
+	}
 	ok := true
 	if !*overwrite {
 		client_file, port, server_file, dashboard_port, ok = readConfig(v)
+		if !ok && *headless {
+			printErr("The config file is required in the headless mode")
+			os.Exit(1)
+		}
 		if !ok {
 			*overwrite = true
 		} else {
@@ -892,45 +1248,73 @@ func main() {
 			printSuccess("dashboard_port: " + dashboard_port)
 		}
 	}
+	err = initPolicy(v)
+	if err != nil {
+		printErr(err.Error())
+		os.Exit(1)
+	}
+	if *overwrite && getPolicy().Headless {
+		printErr("-n asks for the config values, it can't be used in the headless mode")
+		os.Exit(1)
+	}
 	err, client_file = initProject(client_file)
 	if err != nil {
 		printErr(err.Error())
 		os.Exit(1)
 	}
-	in, port, err := initCliConn(port)
+	tlsConfig, err := initTLS(v)
 	if err != nil {
 		printErr(err.Error())
 		os.Exit(1)
 	}
-	GetServer, server_file, err := initClientServer(server_file)
+	initAuth(v)
+	err = loadRegistry(v.GetString("NodesFile"))
+	if err != nil {
+		printErr("Could not load the node registry: " + err.Error())
+		os.Exit(1)
+	}
+	in, port, err := initCliConn(v.GetString("BindAddr"), port, tlsConfig)
 	if err != nil {
 		printErr(err.Error())
 		os.Exit(1)
 	}
-	err = initPluginStruct(GetServer)
+	server_file, err = initClientServer(server_file)
+	if err != nil {
+		printErr(err.Error())
+		os.Exit(1)
+	}
+	CodeMode = v.GetString("CodeMode")
+	if CodeMode != "source" && CodeMode != "binary" {
+		printErr("CodeMode must be \"source\" or \"binary\", got \"" + CodeMode + "\"")
+		os.Exit(1)
+	}
+	NodeTimeout = v.GetDuration("NodeTimeout")
+	if NodeTimeout <= 0 {
+		printWarn("Invalid NodeTimeout, using 30s")
+		NodeTimeout = time.Second * 30
+	}
+	kill := make(chan bool, 1)
+	initContext(kill)
+	err = initJobs(v, client_file, server_file, *resume)
 	if err != nil {
 		printErr(err.Error())
 		os.Exit(1)
 	}
 	initAPI()
-	dashboard_port, webserver := initDashboard(dashboard_port)
+	dashboard_port, webserver := initDashboard(v.GetString("DashboardAddr"), dashboard_port)
 	if *overwrite {
 		err = writeConfig(v, client_file, port, server_file, dashboard_port)
 		if err != nil {
 			printErr(err.Error())
 		}
 	}
-	Status = "READY"
-	kill := make(chan bool, 1)
-	finished = make(chan bool, 1)
-	initContext(kill)
 	t := initTicker()
 	go handleInterrupt(kill, in)
 	go handleCleanExit(kill, logfile, webserver)
-	wg.Add(4)
+	go handleReload()
+	wg.Add(3)
 	go handleDashboard(webserver)
 	go handleClients(t)
 	go processRPC(in)
-	go handleFinish()
 	wg.Wait()
 }
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Settings are the job parameters. The plugin may declare them in the exported Settings struct,
+// the values from the config file take precedence
+type Settings struct {
+	MaxAttempts   int           // Max failures of one WU
+	Timeout       time.Duration // Time before the WU is considered to be stuck, 0 means no limit
+	PrepareAmount int           // Amount of WUs the plugin generates at once, 0 if the plugin decides
+	IOMode        string        // How the node program receives the WU: "stdin", "argv" or "file"
+	Replication   int           // Amount of distinct nodes which compute each WU, the results are compared if it is more than 1
+	Quorum        int           // Amount of agreeing results which accept the WU, a majority of Replication if 0
+}
+
+// defaultSettings are used if neither the plugin nor the config file set the value
+var defaultSettings = Settings{MaxAttempts: 2, IOMode: "stdin", Replication: 1}
+
+// pluginVars are the optional Settings and Timeout variables of the plugin
+type pluginVars struct {
+	settings reflect.Value  // The plugin's Settings struct, the merged values are written back to it
+	timeout  *time.Duration // The plugin's Timeout variable, kept for the plugins without Settings
+}
+
+// lookupSettings finds the optional Settings and Timeout variables of the plugin
+func lookupSettings(lookup func(string) (interface{}, error)) (pluginVars, error) {
+	var vars pluginVars
+	if sym, err := lookup("Timeout"); err == nil {
+		dur, ok := sym.(*time.Duration)
+		if !ok {
+			return vars, errors.New("Timeout must be a time.Duration variable, got " + reflect.TypeOf(sym).String())
+		}
+		vars.timeout = dur
+	}
+	if sym, err := lookup("Settings"); err == nil {
+		// Functions are looked up too, only a pointer to a variable has Elem
+		val := reflect.ValueOf(sym)
+		if val.Kind() != reflect.Ptr || val.Elem().Kind() != reflect.Struct {
+			return vars, errors.New("Settings must be a struct variable, got " + reflect.TypeOf(sym).String())
+		}
+		vars.settings = val.Elem()
+	}
+	return vars, nil
+}
+
+// read copies the values declared by the plugin. It is called after Server.Init
+func (vars pluginVars) read(settings *Settings) error {
+	if vars.timeout != nil {
+		settings.Timeout = *vars.timeout
+	}
+	if !vars.settings.IsValid() {
+		return nil
+	}
+	host := reflect.ValueOf(settings).Elem()
+	for i := 0; i < host.NumField(); i++ {
+		name := host.Type().Field(i).Name
+		f := vars.settings.FieldByName(name)
+		if !f.IsValid() {
+			continue
+		}
+		if f.Type() != host.Field(i).Type() {
+			return errors.New("Settings." + name + " must be " + host.Field(i).Type().String() + ", got " + f.Type().String())
+		}
+		host.Field(i).Set(f)
+	}
+	return nil
+}
+
+// write passes the merged values back to the plugin
+func (vars pluginVars) write(settings Settings) {
+	if vars.timeout != nil {
+		*vars.timeout = settings.Timeout
+	}
+	if !vars.settings.IsValid() {
+		return
+	}
+	host := reflect.ValueOf(settings)
+	for i := 0; i < host.NumField(); i++ {
+		f := vars.settings.FieldByName(host.Type().Field(i).Name)
+		if f.IsValid() && f.CanSet() {
+			f.Set(host.Field(i))
+		}
+	}
+}
+
+// merge overrides the plugin values with the ones from the config file
+func (s *Settings) merge(v *viper.Viper) error {
+	if v.IsSet("MaxAttempts") {
+		n, err := strconv.Atoi(v.GetString("MaxAttempts"))
+		if err != nil {
+			return errors.New("MaxAttempts in the config file must be a number: " + err.Error())
+		}
+		s.MaxAttempts = n
+	}
+	if v.IsSet("Timeout") {
+		d, err := time.ParseDuration(v.GetString("Timeout"))
+		if err != nil {
+			return errors.New("Timeout in the config file must be a duration (e.g. \"10m\"): " + err.Error())
+		}
+		s.Timeout = d
+	}
+	if v.IsSet("PrepareAmount") {
+		n, err := strconv.Atoi(v.GetString("PrepareAmount"))
+		if err != nil {
+			return errors.New("PrepareAmount in the config file must be a number: " + err.Error())
+		}
+		s.PrepareAmount = n
+	}
+	if v.IsSet("IOMode") {
+		s.IOMode = v.GetString("IOMode")
+	}
+	if v.IsSet("Replication") {
+		n, err := strconv.Atoi(v.GetString("Replication"))
+		if err != nil {
+			return errors.New("Replication in the config file must be a number: " + err.Error())
+		}
+		s.Replication = n
+	}
+	if v.IsSet("Quorum") {
+		n, err := strconv.Atoi(v.GetString("Quorum"))
+		if err != nil {
+			return errors.New("Quorum in the config file must be a number: " + err.Error())
+		}
+		s.Quorum = n
+	}
+	return nil
+}
+
+// validate checks the merged values
+func (s Settings) validate() error {
+	if s.MaxAttempts < 1 {
+		return errors.New("MaxAttempts must be at least 1, got " + strconv.Itoa(s.MaxAttempts))
+	}
+	if s.Timeout < 0 {
+		return errors.New("Timeout must not be negative, got " + s.Timeout.String())
+	}
+	if s.PrepareAmount < 0 {
+		return errors.New("PrepareAmount must not be negative, got " + strconv.Itoa(s.PrepareAmount))
+	}
+	if s.IOMode != "stdin" && s.IOMode != "argv" && s.IOMode != "file" {
+		return errors.New("IOMode must be \"stdin\", \"argv\" or \"file\", got \"" + s.IOMode + "\"")
+	}
+	if s.Replication < 1 {
+		return errors.New("Replication must be at least 1, got " + strconv.Itoa(s.Replication))
+	}
+	if s.Quorum < 0 || s.Quorum > s.Replication {
+		return errors.New("Quorum must be from 0 to Replication (" + strconv.Itoa(s.Replication) + "), got " + strconv.Itoa(s.Quorum))
+	}
+	return nil
+}
+
+// buildSettings merges the plugin settings with the job's config and checks them. The job is not changed,
+// so the settings of a new plugin are checked before it replaces the running one
+func (job *Job) buildSettings(vars pluginVars) (Settings, error) {
+	settings := defaultSettings
+	err := vars.read(&settings)
+	if err == nil {
+		err = settings.merge(job.config)
+	}
+	if err == nil {
+		err = settings.validate()
+	}
+	return settings, err
+}
+
+// applySettings makes the checked settings the job's ones and passes them back to the plugin
+func (job *Job) applySettings(vars pluginVars, settings Settings) {
+	job.sched.SetSettings(settings)
+	vars.write(settings)
+	timeout := "no timeout"
+	if settings.Timeout > 0 {
+		timeout = "timeout " + settings.Timeout.String()
+	}
+	printSuccess("Job " + job.Name + " settings: " + strconv.Itoa(settings.MaxAttempts) + " attempt(s) per WU, " + timeout + ", WUs are passed via " + settings.IOMode)
+	if settings.Replication > 1 {
+		printSuccess("Job " + job.Name + ": each WU is computed by " + strconv.Itoa(settings.Replication) + " nodes, " + strconv.Itoa(settings.quorum()) + " agreeing results accept it")
+	}
+}
+
+// quorum returns the amount of agreeing results which accept the WU
+func (s Settings) quorum() int {
+	if s.Quorum > 0 {
+		return s.Quorum
+	}
+	return s.Replication/2 + 1
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func TestMergeSettings(t *testing.T) {
+	tests := []struct {
+		name   string
+		config map[string]interface{}
+		want   Settings
+		merged bool // merge succeeds
+		valid  bool // validate succeeds
+	}{
+		{"defaults", nil, defaultSettings, true, true},
+		{"override", map[string]interface{}{"MaxAttempts": 5, "Timeout": "10m", "PrepareAmount": "20", "IOMode": "file"},
+			Settings{MaxAttempts: 5, Timeout: 10 * time.Minute, PrepareAmount: 20, IOMode: "file", Replication: 1}, true, true},
+		{"quorum", map[string]interface{}{"Replication": 3, "Quorum": 2},
+			Settings{MaxAttempts: 2, IOMode: "stdin", Replication: 3, Quorum: 2}, true, true},
+		{"bad number", map[string]interface{}{"MaxAttempts": "many"}, defaultSettings, false, true},
+		{"bad duration", map[string]interface{}{"Timeout": "10"}, defaultSettings, false, true},
+		{"no attempts", map[string]interface{}{"MaxAttempts": 0}, Settings{IOMode: "stdin", Replication: 1}, true, false},
+		{"negative timeout", map[string]interface{}{"Timeout": "-1m"}, Settings{MaxAttempts: 2, Timeout: -time.Minute, IOMode: "stdin", Replication: 1}, true, false},
+		{"bad IOMode", map[string]interface{}{"IOMode": "pipe"}, Settings{MaxAttempts: 2, IOMode: "pipe", Replication: 1}, true, false},
+		{"no replication", map[string]interface{}{"Replication": 0}, Settings{MaxAttempts: 2, IOMode: "stdin"}, true, false},
+		{"quorum too big", map[string]interface{}{"Replication": 2, "Quorum": 3}, Settings{MaxAttempts: 2, IOMode: "stdin", Replication: 2, Quorum: 3}, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := viper.New()
+			for key, val := range tt.config {
+				v.Set(key, val)
+			}
+			settings := defaultSettings
+			err := settings.merge(v)
+			if (err == nil) != tt.merged {
+				t.Fatalf("merge = %v, want ok: %v", err, tt.merged)
+			}
+			if err != nil {
+				return
+			}
+			if settings != tt.want {
+				t.Errorf("settings = %+v, want %+v", settings, tt.want)
+			}
+			if err := settings.validate(); (err == nil) != tt.valid {
+				t.Errorf("validate = %v, want ok: %v", err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestLookupSettings(t *testing.T) {
+	timeout := time.Minute
+	settings := struct {
+		MaxAttempts int
+		Replication int
+	}{MaxAttempts: 3, Replication: 5}
+	wrongType := struct{ MaxAttempts string }{"many"}
+	tests := []struct {
+		name    string
+		symbols map[string]interface{}
+		found   bool // lookupSettings succeeds
+		valid   bool // buildSettings succeeds
+	}{
+		{"none", map[string]interface{}{}, true, false},
+		{"variables", map[string]interface{}{"Timeout": &timeout, "Settings": &settings}, true, true},
+		{"function", map[string]interface{}{"Settings": func() {}}, false, false},
+		{"not a pointer", map[string]interface{}{"Timeout": timeout}, false, false},
+		{"wrong field type", map[string]interface{}{"Settings": &wrongType}, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vars, err := lookupSettings(func(name string) (interface{}, error) {
+				sym, ok := tt.symbols[name]
+				if !ok {
+					return nil, errors.New("symbol " + name + " not found")
+				}
+				return sym, nil
+			})
+			if (err == nil) != tt.found {
+				t.Fatalf("lookupSettings = %v, want ok: %v", err, tt.found)
+			}
+			if err != nil {
+				return
+			}
+			// Quorum in the config is only valid with the Replication of the plugin
+			v := viper.New()
+			v.Set("Quorum", 3)
+			job := &Job{Name: "test", settings: defaultSettings, config: v}
+			_, err = job.buildSettings(vars)
+			if (err == nil) != tt.valid {
+				t.Errorf("buildSettings = %v, want ok: %v", err, tt.valid)
+			}
+			if job.settings != defaultSettings {
+				t.Errorf("buildSettings changed the job settings to %+v", job.settings)
+			}
+		})
+	}
+}
+
+func TestApplySettings(t *testing.T) {
+	timeout := time.Duration(0)
+	settings := struct {
+		MaxAttempts int
+		IOMode      string
+	}{MaxAttempts: 3}
+	vars := pluginVars{settings: reflect.ValueOf(&settings).Elem(), timeout: &timeout}
+	v := viper.New()
+	v.Set("Timeout", "1m")
+	v.Set("IOMode", "file")
+	job := &Job{Name: "test", config: v}
+	job.sched = NewScheduler(job)
+	merged, err := job.buildSettings(vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job.applySettings(vars, merged)
+	want := Settings{MaxAttempts: 3, Timeout: time.Minute, IOMode: "file", Replication: 1}
+	if job.settings != want {
+		t.Errorf("settings = %+v, want %+v", job.settings, want)
+	}
+	// The merged values are passed back to the plugin
+	if timeout != time.Minute || settings.MaxAttempts != 3 || settings.IOMode != "file" {
+		t.Errorf("plugin variables are %v and %+v, want the merged values", timeout, settings)
+	}
+}
+
+// TestSetSettingsConcurrent replaces the settings while the WUs are sent, like a reload does. It is meant for -race
+func TestSetSettingsConcurrent(t *testing.T) {
+	job := newTestJob(defaultSettings)
+	s := job.sched
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			settings := defaultSettings
+			settings.MaxAttempts = i%3 + 1
+			settings.Timeout = time.Duration(i) * time.Second
+			s.SetSettings(settings)
+		}
+	}()
+	client := newTestClient(1)
+	for i := 0; i < 100; i++ {
+		wu := s.Add([]byte("data"), job.wuTimeout([]byte("data")), client, 1)
+		s.Dispatch(wu, "running")
+		s.Fail(wu, "failed")
+		s.Next(client, 1)
+	}
+	<-done
+	if got := s.Settings().Timeout; got != 99*time.Second {
+		t.Errorf("Timeout = %v, want the last settings", got)
+	}
+}
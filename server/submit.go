@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/spf13/viper"
+	"go-panchaea/internal/modpack"
+)
+
+// MaxUpload is the size of the submitted files kept in memory, the rest is written to temporary files
+const MaxUpload = 32 << 20
+
+// submitKeys are the form values of a submitted job, the same as the keys of a job in the config file
+var submitKeys = []string{"Name", "Priority", "Weight", "MaxAttempts", "Timeout", "PrepareAmount", "IOMode", "Replication", "Quorum"}
+
+// validName matches the job names which are safe to use in file names
+var validName = regexp.MustCompile(`^\w[\w.-]*$`)
+
+// submitMut serializes the submissions, so two jobs with the same name are never built at once
+var submitMut sync.Mutex
+
+// handleJobs lists the jobs on GET and submits a new one on POST
+func handleJobs(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		jobs := make([]APIJob, 0)
+		for _, job := range allJobs() {
+			jobs = append(jobs, job.info(job.sched.Stats(), job.progress()))
+		}
+		writeJSON(w, http.StatusOK, jobs)
+	case http.MethodPost:
+		submitMut.Lock()
+		defer submitMut.Unlock()
+		job, code, err := submitJob(r)
+		if err != nil {
+			printErr("Job submission failed: " + err.Error())
+			http.Error(w, err.Error(), code)
+			return
+		}
+		writeJSON(w, http.StatusCreated, job.info(job.sched.Stats(), job.progress()))
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleJobAction shows the job on GET /api/jobs/<id> and pauses, resumes, cancels or finishes it on POST /api/jobs/<id>/<action>
+func handleJobAction(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/jobs/"), "/")
+	ID, err := strconv.Atoi(parts[0])
+	if err != nil || len(parts) > 2 {
+		http.NotFound(w, r)
+		return
+	}
+	job, ok := GetJob(ID)
+	if !ok {
+		http.Error(w, "Job "+parts[0]+" not found", http.StatusNotFound)
+		return
+	}
+	if len(parts) == 1 {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, job.info(job.sched.Stats(), job.progress()))
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	switch parts[1] {
+	case "pause":
+		err = job.Pause()
+	case "resume":
+		err = job.Resume()
+	case "cancel":
+		err = job.Cancel()
+	case "finish":
+		err = job.FinishNow()
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	writeJSON(w, http.StatusOK, job.info(job.sched.Stats(), job.progress()))
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// submitJob saves the uploaded plugin source and client code to jobs/<name>, loads them and adds the job.
+// It returns the HTTP status code on error
+func submitJob(r *http.Request) (*Job, int, error) {
+	err := r.ParseMultipartForm(MaxUpload)
+	if err != nil {
+		return nil, http.StatusBadRequest, errors.New("Could not parse the form: " + err.Error())
+	}
+	defer r.MultipartForm.RemoveAll()
+	server, shdr, err := r.FormFile("server")
+	if err != nil {
+		return nil, http.StatusBadRequest, errors.New("The plugin source must be sent as \"server\"")
+	}
+	defer server.Close()
+	client, chdr, err := r.FormFile("client")
+	if err != nil {
+		return nil, http.StatusBadRequest, errors.New("The client file or the packed module must be sent as \"client\"")
+	}
+	defer client.Close()
+	server_name, client_name := filepath.Base(shdr.Filename), filepath.Base(chdr.Filename)
+	if filepath.Ext(server_name) != ".go" {
+		return nil, http.StatusBadRequest, errors.New("The plugin source must be a .go file, got \"" + server_name + "\"")
+	}
+	v := viper.New()
+	for _, key := range submitKeys {
+		if val := r.FormValue(key); val != "" {
+			v.Set(key, val)
+		}
+	}
+	name := jobName(v, server_name)
+	if !validName.MatchString(name) {
+		return nil, http.StatusBadRequest, errors.New("Job name may only contain letters, digits, '_', '-' and '.', got \"" + name + "\"")
+	}
+	if _, ok := findJob(name); ok {
+		return nil, http.StatusConflict, errors.New("Job " + name + " already exists")
+	}
+	// The job is not registered, so the files of the previous submission are not used
+	dir := filepath.Join("jobs", name)
+	err = os.RemoveAll(dir)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	job, err := loadSubmitted(v, dir, server, server_name, client, client_name)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, http.StatusBadRequest, err
+	}
+	err = addJob(job)
+	if err != nil {
+		job.journal.Close()
+		return nil, http.StatusConflict, err
+	}
+	return job, http.StatusCreated, nil
+}
+
+// loadSubmitted writes the uploaded files to dir and loads the job. The module archive is unpacked,
+// so it may be built on the server in the binary mode
+func loadSubmitted(v *viper.Viper, dir string, server io.Reader, server_name string, client io.Reader, client_name string) (*Job, error) {
+	server_file := filepath.Join(dir, "server", server_name)
+	err := modpack.WriteFile(server_file, server, 0644)
+	if err != nil {
+		return nil, err
+	}
+	client_file := filepath.Join(dir, "client", client_name)
+	if strings.HasSuffix(client_name, modpack.Suffix) {
+		client_file = strings.TrimSuffix(client_file, modpack.Suffix)
+		data, err := ioutil.ReadAll(client)
+		if err != nil {
+			return nil, err
+		}
+		err = modpack.Unpack(data, client_file)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		err = modpack.WriteFile(client_file, client, 0644)
+		if err != nil {
+			return nil, err
+		}
+	}
+	setJobDefaults(v, server_file)
+	job, err := NewJob(v, client_file, server_file)
+	if err != nil {
+		return nil, err
+	}
+	err = job.Load()
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// runCommand runs a job command against the running server: submit, jobs, pause, resume, cancel or finish
+func runCommand(args []string, v *viper.Viper) error {
+	addr := *api_addr
+	if addr == "" {
+		_, _, _, port, ok := readConfig(v)
+		if !ok || port == "" {
+			return errors.New("Could not find the dashboard port, set it with -api")
+		}
+		host := v.GetString("DashboardAddr")
+		if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+			host = "127.0.0.1"
+		}
+		addr = net.JoinHostPort(host, port)
+	}
+	APIToken = v.GetString("APIToken")
+	base := "http://" + addr + "/api/jobs"
+	switch args[0] {
+	case "submit":
+		return submitCommand(base, args[1:])
+	case "jobs":
+		return listCommand(base)
+	case "pause", "resume", "cancel", "finish":
+		if len(args) != 2 {
+			return errors.New("Usage: " + args[0] + " <job ID>")
+		}
+		var job APIJob
+		err := callAPI(http.MethodPost, base+"/"+args[1]+"/"+args[0], "", nil, &job)
+		if err != nil {
+			return err
+		}
+		if job.Finishing {
+			printSuccess("Job " + strconv.Itoa(job.ID) + " (" + job.Name + ") is finishing")
+			return nil
+		}
+		printSuccess("Job " + strconv.Itoa(job.ID) + " (" + job.Name + ") is " + strings.ToLower(job.Status))
+		return nil
+	}
+	return errors.New("Unknown command \"" + args[0] + "\", expected submit, jobs, pause, resume, cancel or finish")
+}
+
+// submitCommand uploads the plugin source and the client code, the module directory is packed like for the nodes
+func submitCommand(base string, args []string) error {
+	fs := flag.NewFlagSet("submit", flag.ExitOnError)
+	fields := map[string]*string{
+		"Name":     fs.String("name", "", "job name, the server file name by default"),
+		"Priority": fs.String("priority", "", "jobs with a higher priority get the nodes first"),
+		"Weight":   fs.String("weight", "", "share of the nodes among the jobs with the same priority"),
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		return errors.New("Usage: submit [-name name] [-priority n] [-weight n] <server file> <client file or module directory>")
+	}
+	source, err := ioutil.ReadFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	code, filename, err := readClientCode(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for key, val := range fields {
+		if *val != "" {
+			mw.WriteField(key, *val)
+		}
+	}
+	part, err := mw.CreateFormFile("server", filepath.Base(fs.Arg(0)))
+	if err != nil {
+		return err
+	}
+	part.Write(source)
+	part, err = mw.CreateFormFile("client", filename)
+	if err != nil {
+		return err
+	}
+	part.Write(code)
+	err = mw.Close()
+	if err != nil {
+		return err
+	}
+	printSuccess("Submitting the job, the server builds the plugin...")
+	var job APIJob
+	err = callAPI(http.MethodPost, base, mw.FormDataContentType(), &body, &job)
+	if err != nil {
+		return err
+	}
+	printSuccess("Job " + strconv.Itoa(job.ID) + " (" + job.Name + ") is submitted")
+	return nil
+}
+
+// listCommand prints the jobs of the server
+func listCommand(base string) error {
+	var jobs []APIJob
+	err := callAPI(http.MethodGet, base, "", nil, &jobs)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tSTATUS\tPRIORITY\tWEIGHT\tVERSION\tCOMPLETED\tPROGRESS")
+	for _, job := range jobs {
+		total := 0
+		for _, n := range job.Stats {
+			total += n
+		}
+		progress := "-"
+		if job.Progress >= 0 {
+			progress = strconv.Itoa(int(job.Progress*100)) + "%"
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%d\t%d\t%d\t%d/%d\t%s\n", job.ID, job.Name, job.Status, job.Priority, job.Weight, job.Version, job.Stats["completed"], total, progress)
+	}
+	return tw.Flush()
+}
+
+// callAPI sends the request to the job API with APIToken and decodes the reply into out
+func callAPI(method, url, contentType string, body io.Reader, out interface{}) error {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if APIToken != "" {
+		req.Header.Set("Authorization", "Bearer "+APIToken)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		return errors.New(strings.TrimSpace(string(data)))
+	}
+	return json.Unmarshal(data, out)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+
+	"github.com/spf13/viper"
+)
+
+// initTLS loads the server certificate for the RPC listener. It returns nil if TLSCert and TLSKey are not set.
+// If TLSClientCA is set, the nodes must present a certificate signed by it
+func initTLS(v *viper.Viper) (*tls.Config, error) {
+	certFile, keyFile, caFile := v.GetString("TLSCert"), v.GetString("TLSKey"), v.GetString("TLSClientCA")
+	if certFile == "" && keyFile == "" {
+		if caFile != "" {
+			return nil, errors.New("TLSClientCA requires TLSCert and TLSKey")
+		}
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("Both TLSCert and TLSKey must be set")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, errors.New("Could not load the TLS certificate: " + err.Error())
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("No certificates found in " + caFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
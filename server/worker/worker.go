@@ -1,9 +1,52 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"os"
 )
 
+// WorkUnit is a job received from the server
+type WorkUnit struct {
+	Start int
+	End   int
+	Sign  int
+}
+
+// ExitInvalid tells the node that the WU can never be computed, so it is not sent again
+const ExitInvalid = 65
+
+// Result of a WorkUnit
+type Result struct {
+	Sum float64
+}
+
 func main() {
-	fmt.Println("Hello, World!")
+	data, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	var wu WorkUnit
+	err = json.Unmarshal(data, &wu)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(ExitInvalid)
+	}
+	// Part of the Leibniz series for Pi
+	var res Result
+	for k := wu.Start; k < wu.End; k++ {
+		term := 4 / float64(2*k+1)
+		if k%2 != 0 {
+			term = -term
+		}
+		res.Sum += term
+	}
+	out, err := json.Marshal(res)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Stdout.Write(out)
 }